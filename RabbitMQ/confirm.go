@@ -0,0 +1,218 @@
+package RabbitMQ
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// confirmBuffer is how many confirmations and returns can queue up before
+// the client library waits for them to be taken.
+const confirmBuffer = 64
+
+var (
+	// ErrNacked is returned when the broker refuses to take a message.
+	ErrNacked = errors.New("broker did not take the message")
+	// ErrUnroutable is returned when the exchange has no queue bound for
+	// the routing key of a message, which would otherwise be dropped.
+	ErrUnroutable = errors.New("message could not be routed to a queue")
+	// ErrChannelClosed is returned when the channel closes before the
+	// broker confirmed a message; it may or may not have been taken.
+	ErrChannelClosed = errors.New("channel closed before the message was confirmed")
+)
+
+// confirmChannel is a channel in confirm mode, publishing with the mandatory
+// flag. A publish returns once the broker confirmed the message, with an
+// error if it was refused or came back unroutable.
+type confirmChannel struct {
+	ch *amqp.Channel
+	// publishLock keeps publishes in order, so that the delivery tag
+	// counted here is the one the broker confirms.
+	publishLock sync.Mutex
+
+	lock     sync.Mutex
+	nextTag  uint64
+	pending  map[uint64]pendingConfirm
+	returned map[string]amqp.Return
+	err      error
+}
+
+type pendingConfirm struct {
+	messageID string
+	done      chan error
+}
+
+func newConfirmChannel(conn *amqp.Connection) (*confirmChannel, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return nil, err
+	}
+	c := newConfirmState(ch)
+	go c.listen(
+		ch.NotifyPublish(make(chan amqp.Confirmation, confirmBuffer)),
+		ch.NotifyReturn(make(chan amqp.Return, confirmBuffer)),
+	)
+	return c, nil
+}
+
+func newConfirmState(ch *amqp.Channel) *confirmChannel {
+	return &confirmChannel{
+		ch:       ch,
+		nextTag:  1,
+		pending:  make(map[uint64]pendingConfirm),
+		returned: make(map[string]amqp.Return),
+	}
+}
+
+// publish sends msg and waits for the broker to confirm it. Messages without
+// an ID are given one, which is how a returned message is told apart.
+func (c *confirmChannel) publish(ctx context.Context, exchange, key string, msg Message) error {
+	publishing := msg.publishing()
+	if publishing.MessageId == "" {
+		publishing.MessageId = newMessageID()
+	}
+	done := make(chan error, 1)
+
+	c.publishLock.Lock()
+	c.lock.Lock()
+	if c.err != nil {
+		c.lock.Unlock()
+		c.publishLock.Unlock()
+		return c.err
+	}
+	tag := c.nextTag
+	c.pending[tag] = pendingConfirm{messageID: publishing.MessageId, done: done}
+	c.lock.Unlock()
+
+	err := c.ch.Publish(
+		exchange, // exchange
+		key,      // routing key
+		true,     // mandatory
+		false,    // immediate
+		publishing,
+	)
+
+	c.lock.Lock()
+	if err != nil {
+		delete(c.pending, tag)
+	} else {
+		c.nextTag++
+	}
+	c.lock.Unlock()
+	c.publishLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		// The broker may still take the message; done is buffered, so
+		// the confirmation doesn't wait for anyone.
+		return ctx.Err()
+	}
+}
+
+// listen resolves publishes as their confirmations arrive, until the channel
+// closes.
+func (c *confirmChannel) listen(confirms <-chan amqp.Confirmation, returns <-chan amqp.Return) {
+	for {
+		select {
+		case ret, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			c.noteReturn(ret)
+		case confirm, ok := <-confirms:
+			if !ok {
+				c.fail(ErrChannelClosed)
+				return
+			}
+			// The broker returns a message before confirming it, and
+			// the library hands the return over first, so it is waiting
+			// if there is one.
+			for drained := false; !drained; {
+				select {
+				case ret, ok := <-returns:
+					if ok {
+						c.noteReturn(ret)
+					} else {
+						returns, drained = nil, true
+					}
+				default:
+					drained = true
+				}
+			}
+			c.resolve(confirm)
+		}
+	}
+}
+
+func (c *confirmChannel) noteReturn(ret amqp.Return) {
+	log.Printf("RabbitMQ: message %s returned by %s: %d %s",
+		ret.MessageId, ret.Exchange, ret.ReplyCode, ret.ReplyText)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.returned[ret.MessageId] = ret
+}
+
+func (c *confirmChannel) resolve(confirm amqp.Confirmation) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	pending, ok := c.pending[confirm.DeliveryTag]
+	if !ok {
+		return
+	}
+	delete(c.pending, confirm.DeliveryTag)
+	ret, returned := c.returned[pending.messageID]
+	delete(c.returned, pending.messageID)
+	switch {
+	case !confirm.Ack:
+		pending.done <- ErrNacked
+	case returned:
+		pending.done <- fmt.Errorf("%w: %s with routing key %q: %s",
+			ErrUnroutable, ret.Exchange, ret.RoutingKey, ret.ReplyText)
+	default:
+		pending.done <- nil
+	}
+}
+
+// fail fails every unconfirmed publish, and every later one, with err.
+func (c *confirmChannel) fail(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.err = err
+	for tag, pending := range c.pending {
+		pending.done <- err
+		delete(c.pending, tag)
+	}
+}
+
+// alive tells whether the channel can still publish.
+func (c *confirmChannel) alive() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err == nil
+}
+
+func newMessageID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// Only returned messages need telling apart; a message without
+		// an ID is still confirmed.
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,62 @@
+package RabbitMQ
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestConfirmChannelResolvesPublishes(t *testing.T) {
+	c := newConfirmState(nil)
+	confirms := make(chan amqp.Confirmation, confirmBuffer)
+	returns := make(chan amqp.Return, confirmBuffer)
+	done := make(chan struct{})
+	go func() {
+		c.listen(confirms, returns)
+		close(done)
+	}()
+
+	wait := func(tag uint64, messageID string) chan error {
+		result := make(chan error, 1)
+		c.lock.Lock()
+		c.pending[tag] = pendingConfirm{messageID: messageID, done: result}
+		c.lock.Unlock()
+		return result
+	}
+	acked, returned, nacked, unconfirmed := wait(1, "a"), wait(2, "b"), wait(3, "c"), wait(4, "d")
+
+	confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+	// Like the client library: the return is handed over before the ack.
+	returns <- amqp.Return{MessageId: "b", Exchange: "cake.events", RoutingKey: "user.nobody", ReplyText: "NO_ROUTE"}
+	confirms <- amqp.Confirmation{DeliveryTag: 2, Ack: true}
+	confirms <- amqp.Confirmation{DeliveryTag: 3, Ack: false}
+	close(confirms)
+	close(returns)
+
+	cases := []struct {
+		name   string
+		result chan error
+		want   error
+	}{
+		{"acked", acked, nil},
+		{"returned", returned, ErrUnroutable},
+		{"nacked", nacked, ErrNacked},
+		{"unconfirmed when the channel closed", unconfirmed, ErrChannelClosed},
+	}
+	for _, tc := range cases {
+		select {
+		case err := <-tc.result:
+			if !errors.Is(err, tc.want) {
+				t.Errorf("%s: got %v; want %v", tc.name, err, tc.want)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s: not resolved", tc.name)
+		}
+	}
+	<-done
+	if c.alive() {
+		t.Error("channel still alive after its confirmations closed")
+	}
+}
@@ -0,0 +1,237 @@
+package RabbitMQ
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// ConnState is where a ConnectionManager is in its life.
+type ConnState int
+
+const (
+	StateConnecting ConnState = iota
+	StateConnected
+	// StateDisconnected is the wait before dialing again.
+	StateDisconnected
+	StateClosed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateClosed:
+		return "closed"
+	default:
+		return fmt.Sprintf("ConnState(%d)", int(s))
+	}
+}
+
+var (
+	ErrNotConnected     = errors.New("not connected to RabbitMQ")
+	ErrConnectionClosed = errors.New("connection manager closed")
+)
+
+// Topology declares exchanges, queues and bindings on ch. It runs on every
+// connection, so what a broker restart lost is there again.
+type Topology func(ch *amqp.Channel) error
+
+// DeclareExchange is the Topology of a durable exchange of kind.
+func DeclareExchange(name, kind string) Topology {
+	return func(ch *amqp.Channel) error {
+		return ch.ExchangeDeclare(
+			name,  // name
+			kind,  // type
+			true,  // durable
+			false, // auto-deleted
+			false, // internal
+			false, // no-wait
+			nil,   // arguments
+		)
+	}
+}
+
+// ConnectionManager keeps a connection to the broker open. When it drops the
+// manager dials again, waiting a jittered, doubling backoff between attempts,
+// and declares the topology anew before handing the connection out.
+type ConnectionManager struct {
+	url        string
+	topology   []Topology
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	dial       func(url string) (*amqp.Connection, error)
+
+	lock  sync.RWMutex
+	conn  *amqp.Connection
+	state ConnState
+	err   error
+	// ready is closed while connected, and for good once closed, to wake
+	// WaitConnection. It is replaced when the connection drops.
+	ready       chan struct{}
+	readyClosed bool
+}
+
+func NewConnectionManager(config Config, topology ...Topology) *ConnectionManager {
+	return &ConnectionManager{
+		url:        config.URL,
+		topology:   topology,
+		minBackoff: config.ReconnectBackoff,
+		maxBackoff: config.MaxReconnectBackoff,
+		dial:       amqp.Dial,
+		state:      StateConnecting,
+		ready:      make(chan struct{}),
+	}
+}
+
+// Run connects and reconnects until ctx is done, then closes the connection.
+func (m *ConnectionManager) Run(ctx context.Context) {
+	backoff := m.minBackoff
+	// lastErr stays reported while connecting again.
+	var lastErr error
+	for {
+		m.setState(StateConnecting, nil, lastErr)
+		conn, err := m.connect()
+		if err != nil {
+			lastErr = err
+			delay := Jitter(backoff)
+			log.Printf("RabbitMQ: could not connect, retrying in %s: %s", delay, err)
+			m.setState(StateDisconnected, nil, err)
+			select {
+			case <-ctx.Done():
+				m.setState(StateClosed, nil, ErrConnectionClosed)
+				return
+			case <-time.After(delay):
+			}
+			if backoff *= 2; backoff > m.maxBackoff {
+				backoff = m.maxBackoff
+			}
+			continue
+		}
+		backoff, lastErr = m.minBackoff, nil
+		closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+		m.setState(StateConnected, conn, nil)
+		log.Printf("RabbitMQ: connected")
+
+		select {
+		case <-ctx.Done():
+			m.setState(StateClosed, nil, ErrConnectionClosed)
+			conn.Close()
+			return
+		case amqpErr := <-closed:
+			// A nil error means the connection was closed on purpose,
+			// which only Run does.
+			lastErr = ErrNotConnected
+			if amqpErr != nil {
+				lastErr = amqpErr
+			}
+			log.Printf("RabbitMQ: connection lost: %s", lastErr)
+			m.setState(StateDisconnected, nil, lastErr)
+		}
+	}
+}
+
+func (m *ConnectionManager) connect() (*amqp.Connection, error) {
+	conn, err := m.dial(m.url)
+	if err != nil {
+		return nil, err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	defer ch.Close()
+	for _, declare := range m.topology {
+		if err := declare(ch); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("declare topology: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+func (m *ConnectionManager) setState(state ConnState, conn *amqp.Connection, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	wake := state == StateConnected || state == StateClosed
+	if wake && !m.readyClosed {
+		close(m.ready)
+		m.readyClosed = true
+	} else if !wake && m.readyClosed {
+		m.ready = make(chan struct{})
+		m.readyClosed = false
+	}
+	m.state, m.conn, m.err = state, conn, err
+}
+
+// State returns the current state and, unless connected, the error that
+// keeps the manager from being so.
+func (m *ConnectionManager) State() (ConnState, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.state, m.err
+}
+
+// Connection returns the open connection, or ErrNotConnected.
+func (m *ConnectionManager) Connection() (*amqp.Connection, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.state != StateConnected {
+		return nil, m.notConnected()
+	}
+	return m.conn, nil
+}
+
+// WaitConnection waits for the connection to be open, or ctx to be done.
+func (m *ConnectionManager) WaitConnection(ctx context.Context) (*amqp.Connection, error) {
+	for {
+		m.lock.RLock()
+		state, conn, ready := m.state, m.conn, m.ready
+		m.lock.RUnlock()
+		switch state {
+		case StateConnected:
+			return conn, nil
+		case StateClosed:
+			return nil, ErrConnectionClosed
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ready:
+		}
+	}
+}
+
+// Check is a health check passing while connected.
+func (m *ConnectionManager) Check(ctx context.Context) error {
+	_, err := m.Connection()
+	return err
+}
+
+// notConnected explains why there is no connection. Callers hold the lock.
+func (m *ConnectionManager) notConnected() error {
+	if m.err == nil || m.err == ErrNotConnected {
+		return fmt.Errorf("%w: %s", ErrNotConnected, m.state)
+	}
+	return fmt.Errorf("%w: %s: %v", ErrNotConnected, m.state, m.err)
+}
+
+// Jitter picks a wait in [d/2, d), so that clients retrying after the same
+// outage, like a broker restart, don't all retry in step.
+func Jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d-d/2)))
+}
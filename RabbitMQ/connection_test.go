@@ -0,0 +1,96 @@
+package RabbitMQ
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestConnectionManagerRetriesAndCloses(t *testing.T) {
+	config := DefaultConfig()
+	config.ReconnectBackoff = time.Millisecond
+	config.MaxReconnectBackoff = 4 * time.Millisecond
+	manager := NewConnectionManager(config)
+	var attempts int32
+	refused := errors.New("connection refused")
+	manager.dial = func(string) (*amqp.Connection, error) {
+		atomic.AddInt32(&attempts, 1)
+		return nil, refused
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		manager.Run(ctx)
+		close(done)
+	}()
+
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer waitCancel()
+	if _, err := manager.WaitConnection(waitCtx); err != context.DeadlineExceeded {
+		t.Errorf("WaitConnection() while the broker is down = %v; want the context deadline", err)
+	}
+	if n := atomic.LoadInt32(&attempts); n < 3 {
+		t.Errorf("dialed %d times; want retries", n)
+	}
+	if err := manager.Check(context.Background()); !errors.Is(err, ErrNotConnected) || !strings.Contains(err.Error(), refused.Error()) {
+		t.Errorf("Check() = %v; want ErrNotConnected with the dial error", err)
+	}
+	if state, stateErr := manager.State(); state == StateConnected || stateErr == nil {
+		t.Errorf("State() = %s, %v; want a failure", state, stateErr)
+	}
+
+	waiting := make(chan error, 1)
+	go func() {
+		_, err := manager.WaitConnection(context.Background())
+		waiting <- err
+	}()
+	cancel()
+	<-done
+	if state, _ := manager.State(); state != StateClosed {
+		t.Errorf("State() after cancel = %s; want closed", state)
+	}
+	select {
+	case err := <-waiting:
+		if err != ErrConnectionClosed {
+			t.Errorf("WaitConnection() after close = %v; want ErrConnectionClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("WaitConnection() still waiting after close")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	config := DefaultConfig()
+	if err := config.Validate(); err != nil {
+		t.Errorf("DefaultConfig().Validate() = %v", err)
+	}
+	config.MaxReconnectBackoff = config.ReconnectBackoff / 2
+	if err := config.Validate(); err == nil {
+		t.Error("Validate() with max_reconnect_backoff below reconnect_backoff = nil; want error")
+	}
+	config = DefaultConfig()
+	config.EventsQueue = ""
+	if err := config.Validate(); err == nil {
+		t.Error("Validate() without events_queue = nil; want error")
+	}
+}
+
+func TestJitterStaysBelowDelay(t *testing.T) {
+	for _, d := range []time.Duration{0, 1, 2, 3, time.Second} {
+		for i := 0; i < 1000; i++ {
+			got := Jitter(d)
+			if d > 1 && (got < d/2 || got >= d) {
+				t.Fatalf("Jitter(%d) = %d; want within [%d, %d)", d, got, d/2, d)
+			}
+			if d <= 1 && got != d {
+				t.Fatalf("Jitter(%d) = %d; want it unchanged", d, got)
+			}
+		}
+	}
+}
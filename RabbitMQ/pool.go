@@ -0,0 +1,183 @@
+package RabbitMQ
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrPoolClosed is returned for messages handed to a WorkerPool that is
+// shutting down, or that it couldn't publish before its shutdown deadline.
+var ErrPoolClosed = errors.New("worker pool closed")
+
+// WorkerPool publishes messages concurrently: a fixed number of workers, each
+// with its own channel, take messages from a bounded queue. When the queue is
+// full Publish waits for room, so a slow broker slows callers down instead of
+// piling messages up in memory.
+type WorkerPool struct {
+	jobs    chan publishJob
+	workers []*poolWorker
+	// observe, when set, is told about every publish.
+	observe func(worker int, took time.Duration, err error)
+
+	// lock keeps Publish from sending on jobs once Shutdown closed it.
+	lock    sync.RWMutex
+	closing chan struct{}
+	// abort makes the workers fail what is left in the queue.
+	abort     chan struct{}
+	closeOnce sync.Once
+	abortOnce sync.Once
+	running   sync.WaitGroup
+}
+
+type publishJob struct {
+	ctx  context.Context
+	msg  Message
+	done chan error
+}
+
+type poolWorker struct {
+	// The counters come first to be 64-bit aligned for atomic access.
+	published uint64
+	failed    uint64
+	busy      int32
+	id        int
+	publisher *Publisher
+}
+
+// WorkerStats is what a worker did so far.
+type WorkerStats struct {
+	ID        int
+	Published uint64
+	Failed    uint64
+	Busy      bool
+}
+
+// NewWorkerPool starts workers publishing to exchange over the connection of
+// manager, taking messages from a queue holding up to queueSize of them.
+// observe may be nil.
+func NewWorkerPool(manager *ConnectionManager, exchange string, workers, queueSize int, observe func(worker int, took time.Duration, err error)) *WorkerPool {
+	pool := &WorkerPool{
+		jobs:    make(chan publishJob, queueSize),
+		observe: observe,
+		closing: make(chan struct{}),
+		abort:   make(chan struct{}),
+	}
+	for id := 1; id <= workers; id++ {
+		worker := &poolWorker{id: id, publisher: NewPublisher(manager, exchange)}
+		pool.workers = append(pool.workers, worker)
+		pool.running.Add(1)
+		go pool.work(worker)
+	}
+	return pool
+}
+
+// Publish queues msg and waits until a worker published it and the broker
+// confirmed it, ctx is done or the pool shuts down.
+func (pool *WorkerPool) Publish(ctx context.Context, msg Message) error {
+	job := publishJob{ctx: ctx, msg: msg, done: make(chan error, 1)}
+	pool.lock.RLock()
+	select {
+	case <-pool.closing:
+		pool.lock.RUnlock()
+		return ErrPoolClosed
+	default:
+	}
+	select {
+	case pool.jobs <- job:
+		pool.lock.RUnlock()
+	case <-ctx.Done():
+		pool.lock.RUnlock()
+		return ctx.Err()
+	case <-pool.closing:
+		pool.lock.RUnlock()
+		return ErrPoolClosed
+	}
+
+	select {
+	case err := <-job.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (pool *WorkerPool) work(worker *poolWorker) {
+	defer pool.running.Done()
+	for job := range pool.jobs {
+		select {
+		case <-pool.abort:
+			job.done <- ErrPoolClosed
+			continue
+		default:
+		}
+		if err := job.ctx.Err(); err != nil {
+			// Nobody waits for it any more.
+			job.done <- err
+			continue
+		}
+
+		atomic.StoreInt32(&worker.busy, 1)
+		start := time.Now()
+		err := worker.publisher.Publish(job.ctx, job.msg)
+		took := time.Since(start)
+		atomic.StoreInt32(&worker.busy, 0)
+		if err != nil {
+			atomic.AddUint64(&worker.failed, 1)
+		} else {
+			atomic.AddUint64(&worker.published, 1)
+		}
+		if pool.observe != nil {
+			pool.observe(worker.id, took, err)
+		}
+		job.done <- err
+	}
+}
+
+// Shutdown stops taking messages and waits for the workers to publish the
+// ones queued. If ctx is done first, what is still queued fails with
+// ErrPoolClosed and Shutdown returns ctx.Err() once the workers stopped.
+func (pool *WorkerPool) Shutdown(ctx context.Context) error {
+	pool.closeOnce.Do(func() {
+		close(pool.closing)
+		// Wait for Publish calls sending on jobs to give up.
+		pool.lock.Lock()
+		close(pool.jobs)
+		pool.lock.Unlock()
+	})
+
+	stopped := make(chan struct{})
+	go func() {
+		pool.running.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		pool.abortOnce.Do(func() { close(pool.abort) })
+		<-stopped
+		return ctx.Err()
+	}
+}
+
+// Queued is the number of messages waiting for a worker.
+func (pool *WorkerPool) Queued() int {
+	return len(pool.jobs)
+}
+
+// Stats reports what each worker did so far.
+func (pool *WorkerPool) Stats() []WorkerStats {
+	stats := make([]WorkerStats, len(pool.workers))
+	for i, worker := range pool.workers {
+		stats[i] = WorkerStats{
+			ID:        worker.id,
+			Published: atomic.LoadUint64(&worker.published),
+			Failed:    atomic.LoadUint64(&worker.failed),
+			Busy:      atomic.LoadInt32(&worker.busy) == 1,
+		}
+	}
+	return stats
+}
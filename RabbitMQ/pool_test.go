@@ -0,0 +1,115 @@
+package RabbitMQ
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolPublishesAndShutsDown(t *testing.T) {
+	// Never run, so publishes fail right away for want of a connection.
+	manager := NewConnectionManager(DefaultConfig())
+	var lock sync.Mutex
+	observed := map[int]int{}
+	pool := NewWorkerPool(manager, "events", 2, 4, func(worker int, took time.Duration, err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if !errors.Is(err, ErrNotConnected) {
+			t.Errorf("observed %v; want ErrNotConnected", err)
+		}
+		observed[worker]++
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := pool.Publish(context.Background(), NewMessage("hello", "")); !errors.Is(err, ErrNotConnected) {
+				t.Errorf("Publish() = %v; want ErrNotConnected", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	failed := uint64(0)
+	for _, stats := range pool.Stats() {
+		failed += stats.Failed
+		if stats.Published != 0 || stats.Busy {
+			t.Errorf("worker %d: %+v; want only failures", stats.ID, stats)
+		}
+		lock.Lock()
+		if uint64(observed[stats.ID]) != stats.Failed {
+			t.Errorf("worker %d observed %d publishes; want %d", stats.ID, observed[stats.ID], stats.Failed)
+		}
+		lock.Unlock()
+	}
+	if failed != 10 {
+		t.Errorf("workers failed %d publishes; want 10", failed)
+	}
+
+	if err := pool.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() = %v", err)
+	}
+	if err := pool.Publish(context.Background(), NewMessage("late", "")); err != ErrPoolClosed {
+		t.Errorf("Publish() after Shutdown = %v; want ErrPoolClosed", err)
+	}
+	if err := pool.Shutdown(context.Background()); err != nil {
+		t.Errorf("second Shutdown() = %v", err)
+	}
+}
+
+func TestWorkerPoolBackpressureAndAbort(t *testing.T) {
+	manager := NewConnectionManager(DefaultConfig())
+	// The worker stays busy until release is closed.
+	release := make(chan struct{})
+	pool := NewWorkerPool(manager, "events", 1, 1, func(int, time.Duration, error) {
+		<-release
+	})
+
+	results := make(chan error, 2)
+	publish := func() {
+		results <- pool.Publish(context.Background(), NewMessage("hello", ""))
+	}
+	go publish()
+	waitFor(t, "the worker to take the first message", func() bool { return pool.Stats()[0].Failed == 1 })
+	go publish()
+	waitFor(t, "the second message to be queued", func() bool { return pool.Queued() == 1 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := pool.Publish(ctx, NewMessage("hello", "")); err != context.DeadlineExceeded {
+		t.Errorf("Publish() with a full queue = %v; want the context deadline", err)
+	}
+
+	expired, expire := context.WithCancel(context.Background())
+	expire()
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- pool.Shutdown(expired) }()
+	<-pool.abort
+	close(release)
+
+	if err := <-shutdown; err != context.Canceled {
+		t.Errorf("Shutdown() past its deadline = %v; want context.Canceled", err)
+	}
+	got := []error{<-results, <-results}
+	if got[0] == ErrPoolClosed {
+		got[0], got[1] = got[1], got[0]
+	}
+	if !errors.Is(got[0], ErrNotConnected) || got[1] != ErrPoolClosed {
+		t.Errorf("Publish() results = %v; want ErrNotConnected, and ErrPoolClosed for the queued message", got)
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,93 @@
+package RabbitMQ
+
+import (
+	"context"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// Publisher publishes messages to the topic exchange named by
+// Config.EventsExchange, each under its own routing key, over the connection
+// of a ConnectionManager. Without a connection it fails right away rather
+// than waiting, so callers can keep the message and try again later.
+type Publisher struct {
+	manager  *ConnectionManager
+	exchange string
+
+	lock sync.Mutex
+	conn *amqp.Connection
+	ch   *confirmChannel
+}
+
+func NewPublisher(manager *ConnectionManager, exchange string) *Publisher {
+	return &Publisher{manager: manager, exchange: exchange}
+}
+
+// eventsBindingKey matches the routing key of every event type.
+const eventsBindingKey = "user.#"
+
+// EventsTopology declares the exchange a Publisher publishes to, and the
+// queue that keeps every event; its ConnectionManager has to be made with it.
+func (c Config) EventsTopology() Topology {
+	declareExchange := DeclareExchange(c.EventsExchange, "topic")
+	return func(ch *amqp.Channel) error {
+		if err := declareExchange(ch); err != nil {
+			return err
+		}
+		q, err := ch.QueueDeclare(
+			c.EventsQueue, // name
+			true,          // durable
+			false,         // delete when unused
+			false,         // exclusive
+			false,         // no-wait
+			nil,           // arguments
+		)
+		if err != nil {
+			return err
+		}
+		return ch.QueueBind(
+			q.Name,           // queue name
+			eventsBindingKey, // routing key
+			c.EventsExchange, // exchange
+			false,            // no-wait
+			nil,              // arguments
+		)
+	}
+}
+
+// Publish sends msg under its routing key and returns once the broker has
+// confirmed it. It fails with ErrNacked or ErrUnroutable when the broker
+// refused or couldn't route the message, and ErrChannelClosed when the
+// channel closed first; then the message may have to be sent again.
+func (p *Publisher) Publish(ctx context.Context, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ch, err := p.channel()
+	if err != nil {
+		return err
+	}
+	return ch.publish(ctx, p.exchange, msg.routingKey, msg)
+}
+
+// channel returns the channel to publish on, opening one on the current
+// connection when there is none, it closed, or it belongs to a previous
+// connection.
+func (p *Publisher) channel() (*confirmChannel, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	conn, err := p.manager.Connection()
+	if err != nil {
+		return nil, err
+	}
+	if p.ch != nil && p.conn == conn && p.ch.alive() {
+		return p.ch, nil
+	}
+	ch, err := newConfirmChannel(conn)
+	if err != nil {
+		return nil, err
+	}
+	p.conn, p.ch = conn, ch
+	return ch, nil
+}
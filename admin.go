@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// AdminUser is what admins get to see of a user: everything but the password.
+type AdminUser struct {
+	Email        string   `json:"email"`
+	FavoriteCake string   `json:"favorite_cake"`
+	Role         Role     `json:"role"`
+	Banned       bool     `json:"banned"`
+	Ban          *BanInfo `json:"ban,omitempty"`
+}
+
+type BanInfo struct {
+	BannedAt time.Time  `json:"banned_at"`
+	Until    *time.Time `json:"until,omitempty"`
+	Reason   string     `json:"reason"`
+	BannedBy string     `json:"banned_by"`
+}
+
+type UserPage struct {
+	Users  []AdminUser `json:"users"`
+	Total  int         `json:"total"`
+	Offset int         `json:"offset"`
+	Limit  int         `json:"limit"`
+}
+
+type BanParams struct {
+	Reason string     `json:"reason"`
+	Until  *time.Time `json:"until"`
+}
+
+func newAdminUser(u User, now time.Time) AdminUser {
+	view := AdminUser{
+		Email:        u.Email,
+		FavoriteCake: u.FavoriteCake,
+		Role:         u.Role.Effective(),
+		Banned:       u.Ban.Active(now),
+	}
+	if view.Banned {
+		view.Ban = &BanInfo{
+			BannedAt: u.Ban.BannedAt,
+			Reason:   u.Ban.Reason,
+			BannedBy: u.Ban.BannedBy,
+		}
+		if !u.Ban.Until.IsZero() {
+			until := u.Ban.Until
+			view.Ban.Until = &until
+		}
+	}
+	return view
+}
+
+// ListUsers pages through users ordered by email, optionally only the ones
+// whose email starts with the prefix query parameter.
+func (us *UserService) ListUsers(w http.ResponseWriter, r *http.Request, admin User) {
+	query := r.URL.Query()
+	offset, err := queryInt(query.Get("offset"), 0)
+	if err != nil || offset < 0 {
+		handleError(newError(ErrBadRequest, "offset must be a non-negative integer"), w, r)
+		return
+	}
+	limit, err := queryInt(query.Get("limit"), defaultPageSize)
+	if err != nil || limit < 1 || limit > maxPageSize {
+		handleError(newError(ErrBadRequest, "limit must be between 1 and 500"), w, r)
+		return
+	}
+
+	users, total, err := us.repository.List(query.Get("prefix"), offset, limit)
+	if err != nil {
+		handleError(err, w, r)
+		return
+	}
+	page := UserPage{
+		Users:  make([]AdminUser, 0, len(users)),
+		Total:  total,
+		Offset: offset,
+		Limit:  limit,
+	}
+	now := time.Now()
+	for _, u := range users {
+		page.Users = append(page.Users, newAdminUser(u, now))
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+func (us *UserService) GetUser(w http.ResponseWriter, r *http.Request, admin User) {
+	user, err := us.repository.Get(mux.Vars(r)["email"])
+	if err != nil {
+		handleError(err, w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, newAdminUser(user, time.Now()))
+}
+
+// BanUser bans the user until the optional expiry. Admins can only ban users
+// ranked below them.
+func (us *UserService) BanUser(w http.ResponseWriter, r *http.Request, admin User) {
+	params := &BanParams{}
+	err := json.NewDecoder(r.Body).Decode(params)
+	if err != nil {
+		handleError(newError(ErrBadRequest, "could not read params"), w, r)
+		return
+	}
+	if params.Reason == "" {
+		handleError(newValidationError("reason", "the ban reason is empty"), w, r)
+		return
+	}
+	now := time.Now()
+	if params.Until != nil && !params.Until.After(now) {
+		handleError(newValidationError("until", "the ban expiry is in the past"), w, r)
+		return
+	}
+
+	user, err := us.moderatedUser(r, admin)
+	if err != nil {
+		handleError(err, w, r)
+		return
+	}
+	ban := Ban{
+		BannedAt: now,
+		Reason:   params.Reason,
+		BannedBy: admin.Email,
+	}
+	if params.Until != nil {
+		ban.Until = *params.Until
+	}
+	user, err = us.repository.Modify(user.Email, func(user *User) ([]Event, error) {
+		user.Ban = ban
+		return nil, nil
+	})
+	if err != nil {
+		handleError(err, w, r)
+		return
+	}
+	us.revokeTokens(user.Email)
+	writeJSON(w, http.StatusOK, newAdminUser(user, now))
+}
+
+func (us *UserService) UnbanUser(w http.ResponseWriter, r *http.Request, admin User) {
+	user, err := us.moderatedUser(r, admin)
+	if err != nil {
+		handleError(err, w, r)
+		return
+	}
+	user, err = us.repository.Modify(user.Email, func(user *User) ([]Event, error) {
+		user.Ban = Ban{}
+		return nil, nil
+	})
+	if err != nil {
+		handleError(err, w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, newAdminUser(user, time.Now()))
+}
+
+// ClearLockout lets a user locked out by failed logins try again right away.
+func (us *UserService) ClearLockout(w http.ResponseWriter, r *http.Request, admin User) {
+	user, err := us.moderatedUser(r, admin)
+	if err != nil {
+		handleError(err, w, r)
+		return
+	}
+	us.lockout.Clear(user.Email)
+	writeJSON(w, http.StatusOK, newAdminUser(user, time.Now()))
+}
+
+func (us *UserService) moderatedUser(r *http.Request, admin User) (User, error) {
+	email := mux.Vars(r)["email"]
+	if email == admin.Email {
+		return User{}, newError(ErrForbidden, "can't moderate yourself")
+	}
+	user, err := us.repository.Get(email)
+	if err != nil {
+		return User{}, err
+	}
+	if user.Role.Includes(admin.Role) {
+		return User{}, newError(ErrForbidden, "can't moderate a user of the same or a higher role")
+	}
+	return user, nil
+}
+
+func queryInt(value string, fallback int) (int, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	return strconv.Atoi(value)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		handleError(errors.New("could not encode response"), w, nil)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(out)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func newAdminServer(t *testing.T) (*UserService, *JWTService, *httptest.Server, string) {
+	us := newTestUserService()
+	j, err := NewJWTService(DefaultConfig().JWT)
+	if err != nil {
+		t.FailNow()
+	}
+	us.tokens = j
+	admin := User{Email: "admin@gmail.com", Role: RoleAdmin}
+	us.repository.Add(admin.Email, admin)
+	adminJWT, _ := j.GenearateJWT(admin)
+
+	r := mux.NewRouter()
+	r.HandleFunc("/admin/users", j.AuthorizationJWT(us.repository, RoleAdmin, us.ListUsers))
+	r.HandleFunc("/admin/users/{email}", j.AuthorizationJWT(us.repository, RoleAdmin, us.GetUser))
+	r.HandleFunc("/admin/users/{email}/ban", j.AuthorizationJWT(us.repository, RoleAdmin, us.BanUser)).
+		Methods(http.MethodPut)
+	r.HandleFunc("/admin/users/{email}/ban", j.AuthorizationJWT(us.repository, RoleAdmin, us.UnbanUser)).
+		Methods(http.MethodDelete)
+	r.HandleFunc("/admin/users/{email}/lockout", j.AuthorizationJWT(us.repository, RoleAdmin, us.ClearLockout)).
+		Methods(http.MethodDelete)
+	r.HandleFunc("/user/jwt", wrapJwt(j, us.JWT))
+	return us, j, httptest.NewServer(r), adminJWT
+}
+
+func TestListUsers(t *testing.T) {
+	doRequest := createRequester(t)
+	us, _, ts, adminJWT := newAdminServer(t)
+	defer ts.Close()
+	for _, email := range []string{"bob@gmail.com", "alice@gmail.com", "alex@gmail.com"} {
+		us.repository.Add(email, User{Email: email, PasswordDigest: "secret", FavoriteCake: "citrus"})
+	}
+
+	request, err := http.NewRequest(http.MethodGet, ts.URL+"/admin/users?prefix=al&limit=1&offset=1", nil)
+	request.Header.Set("Authorization", "Bearer "+adminJWT)
+	resp := doRequest(request, err)
+	assertStatus(t, 200, resp)
+	var page UserPage
+	if err := json.Unmarshal(resp.body, &page); err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 2 || len(page.Users) != 1 || page.Users[0].Email != "alice@gmail.com" {
+		t.Errorf("unexpected page: %+v", page)
+	}
+	if regexp.MustCompile("secret").Match(resp.body) {
+		t.Errorf("password digest leaked: %s", resp.body)
+	}
+
+	request, err = http.NewRequest(http.MethodGet, ts.URL+"/admin/users?limit=0", nil)
+	request.Header.Set("Authorization", "Bearer "+adminJWT)
+	resp = doRequest(request, err)
+	assertStatus(t, 400, resp)
+}
+
+func TestGetUser(t *testing.T) {
+	doRequest := createRequester(t)
+	us, _, ts, adminJWT := newAdminServer(t)
+	defer ts.Close()
+	us.repository.Add("bob@gmail.com", User{Email: "bob@gmail.com", FavoriteCake: "citrus"})
+
+	request, err := http.NewRequest(http.MethodGet, ts.URL+"/admin/users/bob@gmail.com", nil)
+	request.Header.Set("Authorization", "Bearer "+adminJWT)
+	resp := doRequest(request, err)
+	assertStatus(t, 200, resp)
+	assertBody(t, `{"email":"bob@gmail.com","favorite_cake":"citrus","role":"user","banned":false}`, resp)
+}
+
+func TestBanUser(t *testing.T) {
+	doRequest := createRequester(t)
+	us, j, ts, adminJWT := newAdminServer(t)
+	defer ts.Close()
+	digest, _ := us.hasher.Hash("qwerty123")
+	bob := User{Email: "bob@gmail.com", PasswordDigest: digest, FavoriteCake: "citrus"}
+	us.repository.Add(bob.Email, bob)
+	bobJWT, _ := j.GenearateJWT(bob)
+
+	params := map[string]interface{}{"reason": "spam", "until": time.Now().Add(time.Hour)}
+	request, err := http.NewRequest(http.MethodPut, ts.URL+"/admin/users/bob@gmail.com/ban", prepareParams(t, params))
+	request.Header.Set("Authorization", "Bearer "+adminJWT)
+	resp := doRequest(request, err)
+	assertStatus(t, 200, resp)
+
+	login := httptest.NewServer(http.HandlerFunc(wrapJwt(j, us.JWT)))
+	defer login.Close()
+	credentials := map[string]interface{}{"email": bob.Email, "password": "qwerty123"}
+	resp = doRequest(http.NewRequest(http.MethodPost, login.URL, prepareParams(t, credentials)))
+	assertStatus(t, 403, resp)
+	assertBodyRegex(t, "user is banned until .*: spam", resp)
+
+	// The ban outlives tokens issued before it.
+	j.revocations = NewInMemoryRevocationStore()
+	me := httptest.NewServer(j.AuthenticationJWT(us.repository, us.GetCake))
+	defer me.Close()
+	request, err = http.NewRequest(http.MethodGet, me.URL, nil)
+	request.Header.Set("Authorization", "Bearer "+bobJWT)
+	resp = doRequest(request, err)
+	assertStatus(t, 403, resp)
+
+	request, err = http.NewRequest(http.MethodDelete, ts.URL+"/admin/users/bob@gmail.com/ban", nil)
+	request.Header.Set("Authorization", "Bearer "+adminJWT)
+	resp = doRequest(request, err)
+	assertStatus(t, 200, resp)
+	resp = doRequest(http.NewRequest(http.MethodPost, login.URL, prepareParams(t, credentials)))
+	assertStatus(t, 200, resp)
+}
+
+// Handlers write back users read when the request started; a ban made
+// meanwhile must survive that.
+func TestBanSurvivesConcurrentUpdates(t *testing.T) {
+	doRequest := createRequester(t)
+	us, _, ts, adminJWT := newAdminServer(t)
+	defer ts.Close()
+	digest, _ := us.hasher.Hash("qwerty123")
+	us.repository.Add("bob@gmail.com", User{Email: "bob@gmail.com", PasswordDigest: digest, FavoriteCake: "citrus"})
+	stale, _ := us.repository.Get("bob@gmail.com")
+
+	params := map[string]interface{}{"reason": "spam"}
+	request, err := http.NewRequest(http.MethodPut, ts.URL+"/admin/users/bob@gmail.com/ban", prepareParams(t, params))
+	request.Header.Set("Authorization", "Bearer "+adminJWT)
+	assertStatus(t, 200, doRequest(request, err))
+
+	cake := httptest.NewRequest(http.MethodPut, "/user/favorite_cake", prepareParams(t, map[string]interface{}{"favorite_cake": "cheese"}))
+	us.UpdateCake(httptest.NewRecorder(), cake, stale)
+	password := httptest.NewRequest(http.MethodPut, "/user/password", prepareParams(t, map[string]interface{}{"password": "QWERTy123"}))
+	us.UpdatePassword(httptest.NewRecorder(), password, stale)
+	us.rehashPassword(stale, "qwerty123")
+
+	bob, _ := us.repository.Get("bob@gmail.com")
+	if !bob.Ban.Active(time.Now()) {
+		t.Errorf("ban was overwritten: %+v", bob)
+	}
+	if bob.FavoriteCake != "cheese" {
+		t.Errorf("cake = %q; want the update kept", bob.FavoriteCake)
+	}
+	if ok, _ := us.hasher.Verify("QWERTy123", bob.PasswordDigest); !ok {
+		t.Errorf("the rehash of the old password replaced the new one")
+	}
+}
+
+func TestBanSurvivesEmailUpdate(t *testing.T) {
+	doRequest := createRequester(t)
+	us, _, ts, adminJWT := newAdminServer(t)
+	defer ts.Close()
+	us.repository.Add("bob@gmail.com", User{Email: "bob@gmail.com", FavoriteCake: "citrus"})
+	stale, _ := us.repository.Get("bob@gmail.com")
+
+	params := map[string]interface{}{"reason": "spam"}
+	request, err := http.NewRequest(http.MethodPut, ts.URL+"/admin/users/bob@gmail.com/ban", prepareParams(t, params))
+	request.Header.Set("Authorization", "Bearer "+adminJWT)
+	assertStatus(t, 200, doRequest(request, err))
+
+	email := httptest.NewRequest(http.MethodPut, "/user/email", prepareParams(t, map[string]interface{}{"email": "robert@gmail.com"}))
+	rec := httptest.NewRecorder()
+	us.UpdateEmail(rec, email, stale)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("UpdateEmail status = %d; want 200", rec.Code)
+	}
+
+	bob, err := us.repository.Get("robert@gmail.com")
+	if err != nil {
+		t.Fatalf("Get(new email) = %v; want the user moved", err)
+	}
+	if !bob.Ban.Active(time.Now()) {
+		t.Errorf("ban was overwritten: %+v", bob)
+	}
+}
+
+func TestBanRequiresLowerRole(t *testing.T) {
+	doRequest := createRequester(t)
+	us, _, ts, adminJWT := newAdminServer(t)
+	defer ts.Close()
+	us.repository.Add("root@gmail.com", User{Email: "root@gmail.com", Role: RoleSuperAdmin})
+
+	for _, email := range []string{"root@gmail.com", "admin@gmail.com"} {
+		params := map[string]interface{}{"reason": "spam"}
+		request, err := http.NewRequest(http.MethodPut, ts.URL+"/admin/users/"+email+"/ban", prepareParams(t, params))
+		request.Header.Set("Authorization", "Bearer "+adminJWT)
+		resp := doRequest(request, err)
+		assertStatus(t, 403, resp)
+	}
+}
+
+func TestBanExpires(t *testing.T) {
+	now := time.Now()
+	ban := Ban{BannedAt: now, Until: now.Add(time.Minute), Reason: "spam"}
+	if !ban.Active(now) {
+		t.Error("Active(now) = false; want true")
+	}
+	if ban.Active(now.Add(2 * time.Minute)) {
+		t.Error("Active(after expiry) = true; want false")
+	}
+	if (Ban{}).Active(now) {
+		t.Error("zero Ban is active")
+	}
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang-api/RabbitMQ"
+	"golang-api/ws"
+
+	"gopkg.in/yaml.v2"
+)
+
+// envPrefix starts the environment variable of every setting: the setting
+// jwt.access_ttl is read from CAKE_JWT_ACCESS_TTL.
+const envPrefix = "CAKE_"
+
+// Config is everything the service can be told at startup. Settings come from
+// DefaultConfig, then the config file, then the environment, then the command
+// line, each overriding the one before. Every setting has the same name in all
+// of them: its path in the file.
+type Config struct {
+	Server    ServerConfig    `yaml:"server"`
+	Storage   StorageConfig   `yaml:"storage"`
+	JWT       JWTConfig       `yaml:"jwt"`
+	AMQP      AMQPConfig      `yaml:"amqp"`
+	Outbox    OutboxConfig    `yaml:"outbox"`
+	WebSocket ws.Config       `yaml:"websocket"`
+	Log       LogConfig       `yaml:"log"`
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+	Mail      MailConfig      `yaml:"mail"`
+	// EmailTokens sign the links mailed to users.
+	EmailTokens EmailTokensConfig `yaml:"email_tokens"`
+}
+
+type ServerConfig struct {
+	Addr string `yaml:"addr"`
+	// PublicURL is where users reach the API, the base of mailed links.
+	PublicURL string `yaml:"public_url"`
+	// DrainDelay is how long /readyz fails before the server stops accepting
+	// connections on shutdown.
+	DrainDelay      time.Duration `yaml:"drain_delay"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	TLS             TLSConfig     `yaml:"tls"`
+}
+
+// TLSConfig turns on HTTPS when a certificate is set. The files are read
+// again on SIGHUP.
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// ClientCAFile holds the CAs client certificates are verified against.
+	ClientCAFile string `yaml:"client_ca_file"`
+	// ClientAuth is none, optional (verified when presented) or require.
+	ClientAuth string `yaml:"client_auth"`
+	// RedirectAddr, when set, serves plain HTTP there redirecting to HTTPS.
+	RedirectAddr string `yaml:"redirect_addr"`
+}
+
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != ""
+}
+
+type StorageConfig struct {
+	// Kind is memory, file or sqlite.
+	Kind string `yaml:"kind"`
+	// Path is the log file of the file storage or the database of the
+	// sqlite one.
+	Path string `yaml:"path"`
+}
+
+type JWTConfig struct {
+	PrivateKeyPath   string        `yaml:"private_key"`
+	PublicKeyPath    string        `yaml:"public_key"`
+	AccessTTL        time.Duration `yaml:"access_ttl"`
+	RefreshTTL       time.Duration `yaml:"refresh_ttl"`
+	RotationInterval time.Duration `yaml:"rotation_interval"`
+	GracePeriod      time.Duration `yaml:"grace_period"`
+}
+
+type AMQPConfig struct {
+	Enabled         bool `yaml:"enabled"`
+	RabbitMQ.Config `yaml:",inline"`
+}
+
+type RateLimitConfig struct {
+	IP      RateConfig    `yaml:"ip"`
+	Email   RateConfig    `yaml:"email"`
+	Lockout LockoutConfig `yaml:"lockout"`
+}
+
+// RateConfig is a token bucket: Rate requests per second with bursts of up
+// to Burst. A zero rate turns the limit off.
+type RateConfig struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+// LockoutConfig locks an account for Duration after Threshold consecutive
+// failed logins, doubling with every further failure up to MaxDuration. A
+// zero threshold turns lockouts off.
+type LockoutConfig struct {
+	Threshold   int           `yaml:"threshold"`
+	Duration    time.Duration `yaml:"duration"`
+	MaxDuration time.Duration `yaml:"max_duration"`
+}
+
+type MailConfig struct {
+	// Kind is smtp, or outbox to keep mail in OutboxPath instead.
+	Kind       string     `yaml:"kind"`
+	From       string     `yaml:"from"`
+	OutboxPath string     `yaml:"outbox_path"`
+	SMTP       SMTPConfig `yaml:"smtp"`
+	// VerifyEmail makes new and changed addresses unverified until the
+	// user follows a mailed link. With the default outbox mailer the links
+	// only reach outbox_path, so turning it off is for development.
+	VerifyEmail bool `yaml:"verify_email"`
+}
+
+type SMTPConfig struct {
+	Addr     string `yaml:"addr"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+type EmailTokensConfig struct {
+	// Secret is the HMAC key. Without one a random key is used and links
+	// mailed before a restart stop working.
+	Secret    string        `yaml:"secret"`
+	VerifyTTL time.Duration `yaml:"verify_ttl"`
+	ResetTTL  time.Duration `yaml:"reset_ttl"`
+}
+
+// OutboxConfig paces the relay publishing stored events.
+type OutboxConfig struct {
+	// PollInterval is how often the outbox is checked when the relay isn't
+	// told about new events, e.g. ones stored before a restart.
+	PollInterval time.Duration `yaml:"poll_interval"`
+	BatchSize    int           `yaml:"batch_size"`
+	// MinBackoff is the first wait after a failure, doubled by every
+	// further one up to MaxBackoff.
+	MinBackoff time.Duration `yaml:"min_backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+}
+
+type LogConfig struct {
+	Level        string   `yaml:"level"`
+	RedactFields []string `yaml:"redact_fields"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Server: ServerConfig{
+			Addr:            ":8080",
+			PublicURL:       "http://localhost:8080",
+			DrainDelay:      5 * time.Second,
+			ShutdownTimeout: 5 * time.Second,
+			TLS:             TLSConfig{ClientAuth: clientAuthNone},
+		},
+		Storage: StorageConfig{
+			Kind: "memory",
+			Path: "users.log",
+		},
+		JWT: JWTConfig{
+			// The key files in the repository carry each other's name.
+			PrivateKeyPath:   "pubkey.rsa",
+			PublicKeyPath:    "privkey.rsa",
+			AccessTTL:        accessTokenTTL,
+			RefreshTTL:       refreshTokenTTL,
+			RotationInterval: keyRotationInterval,
+			GracePeriod:      keyGracePeriod,
+		},
+		AMQP: AMQPConfig{Config: RabbitMQ.DefaultConfig()},
+		Outbox: OutboxConfig{
+			PollInterval: 5 * time.Second,
+			BatchSize:    100,
+			MinBackoff:   time.Second,
+			MaxBackoff:   time.Minute,
+		},
+		WebSocket: ws.DefaultConfig(),
+		Log: LogConfig{
+			Level: LevelInfo.String(),
+		},
+		Mail: MailConfig{
+			Kind:        "outbox",
+			From:        "Cake API <noreply@localhost>",
+			OutboxPath:  "outbox.txt",
+			SMTP:        SMTPConfig{Addr: "localhost:587"},
+			VerifyEmail: true,
+		},
+		EmailTokens: EmailTokensConfig{
+			VerifyTTL: verificationTokenTTL,
+			ResetTTL:  passwordResetTokenTTL,
+		},
+		RateLimit: RateLimitConfig{
+			IP:    RateConfig{Rate: 10, Burst: 20},
+			Email: RateConfig{Rate: 0.1, Burst: 5},
+			Lockout: LockoutConfig{
+				Threshold:   5,
+				Duration:    time.Minute,
+				MaxDuration: time.Hour,
+			},
+		},
+	}
+}
+
+// LoadConfig builds the configuration from the file named by -config or
+// CAKE_CONFIG, the environment and args, and validates it.
+func LoadConfig(args []string, lookupEnv func(string) (string, bool)) (Config, error) {
+	path, _ := lookupEnv(envPrefix + "CONFIG")
+	// A first pass over the flags only looks for -config; mistakes are
+	// reported by the second one.
+	probe := DefaultConfig()
+	probeFlags := probe.flagSet(&path)
+	probeFlags.SetOutput(ioutil.Discard)
+	probeFlags.Parse(args)
+
+	cfg := DefaultConfig()
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return Config{}, fmt.Errorf("config file %s: %w", path, err)
+		}
+	}
+	flags := cfg.flagSet(&path)
+	var problems []string
+	flags.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+		name := envName(f.Name)
+		if value, ok := lookupEnv(name); ok {
+			if err := flags.Set(f.Name, value); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+			}
+		}
+	})
+	if len(problems) > 0 {
+		return Config{}, &ConfigError{Problems: problems}
+	}
+	if err := flags.Parse(args); err != nil {
+		return Config{}, err
+	}
+	return cfg, cfg.Validate()
+}
+
+func (c *Config) loadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	// JSON is YAML too. Strict so that a misspelt setting isn't ignored.
+	return yaml.UnmarshalStrict(data, c)
+}
+
+// flagSet binds a flag to every setting of c, defaulting to its current value.
+func (c *Config) flagSet(configPath *string) *flag.FlagSet {
+	fs := flag.NewFlagSet("cake-api", flag.ContinueOnError)
+	fs.StringVar(configPath, "config", *configPath, "YAML or JSON config file (env "+envPrefix+"CONFIG)")
+
+	fs.StringVar(&c.Server.Addr, "server.addr", c.Server.Addr, "address to listen on")
+	fs.DurationVar(&c.Server.DrainDelay, "server.drain_delay", c.Server.DrainDelay, "how long /readyz fails before shutdown stops accepting connections")
+	fs.DurationVar(&c.Server.ShutdownTimeout, "server.shutdown_timeout", c.Server.ShutdownTimeout, "how long in-flight requests get to finish on shutdown")
+
+	fs.StringVar(&c.Server.PublicURL, "server.public_url", c.Server.PublicURL, "URL users reach the API at, used in mailed links")
+
+	fs.StringVar(&c.Server.TLS.CertFile, "server.tls.cert_file", c.Server.TLS.CertFile, "PEM certificate chain; enables HTTPS")
+	fs.StringVar(&c.Server.TLS.KeyFile, "server.tls.key_file", c.Server.TLS.KeyFile, "PEM private key of the certificate")
+	fs.StringVar(&c.Server.TLS.ClientCAFile, "server.tls.client_ca_file", c.Server.TLS.ClientCAFile, "PEM CAs client certificates are verified against")
+	fs.StringVar(&c.Server.TLS.ClientAuth, "server.tls.client_auth", c.Server.TLS.ClientAuth, "client certificates: none, optional or require")
+	fs.StringVar(&c.Server.TLS.RedirectAddr, "server.tls.redirect_addr", c.Server.TLS.RedirectAddr, "address to redirect plain HTTP to HTTPS from")
+
+	fs.StringVar(&c.Storage.Kind, "storage.kind", c.Storage.Kind, "where users are kept: memory, file or sqlite")
+	fs.StringVar(&c.Storage.Path, "storage.path", c.Storage.Path, "log file of the file storage or database of the sqlite storage")
+
+	fs.StringVar(&c.JWT.PrivateKeyPath, "jwt.private_key", c.JWT.PrivateKeyPath, "PEM file with the RSA signing key, generated when missing")
+	fs.StringVar(&c.JWT.PublicKeyPath, "jwt.public_key", c.JWT.PublicKeyPath, "PEM file with the RSA public key")
+	fs.DurationVar(&c.JWT.AccessTTL, "jwt.access_ttl", c.JWT.AccessTTL, "lifetime of access tokens")
+	fs.DurationVar(&c.JWT.RefreshTTL, "jwt.refresh_ttl", c.JWT.RefreshTTL, "lifetime of refresh tokens")
+	fs.DurationVar(&c.JWT.RotationInterval, "jwt.rotation_interval", c.JWT.RotationInterval, "how often a new signing key is generated, 0 disables rotation")
+	fs.DurationVar(&c.JWT.GracePeriod, "jwt.grace_period", c.JWT.GracePeriod, "how long a retired signing key keeps verifying tokens")
+
+	fs.BoolVar(&c.AMQP.Enabled, "amqp.enabled", c.AMQP.Enabled, "use RabbitMQ")
+	fs.StringVar(&c.AMQP.URL, "amqp.url", c.AMQP.URL, "RabbitMQ URL")
+	fs.StringVar(&c.AMQP.Exchange, "amqp.exchange", c.AMQP.Exchange, "exchange messages are published to")
+	fs.StringVar(&c.AMQP.EventsExchange, "amqp.events_exchange", c.AMQP.EventsExchange, "topic exchange domain events are published to")
+	fs.StringVar(&c.AMQP.EventsQueue, "amqp.events_queue", c.AMQP.EventsQueue, "durable queue bound to every event type")
+	fs.DurationVar(&c.AMQP.ReconnectBackoff, "amqp.reconnect_backoff", c.AMQP.ReconnectBackoff, "first wait before reconnecting to RabbitMQ, doubled by every failure")
+	fs.DurationVar(&c.AMQP.MaxReconnectBackoff, "amqp.max_reconnect_backoff", c.AMQP.MaxReconnectBackoff, "longest wait between attempts to reconnect to RabbitMQ")
+	fs.IntVar(&c.AMQP.Workers, "amqp.workers", c.AMQP.Workers, "workers publishing to RabbitMQ at once, each on its own channel")
+	fs.IntVar(&c.AMQP.QueueSize, "amqp.queue_size", c.AMQP.QueueSize, "messages waiting for a publishing worker before publishers block")
+
+	fs.DurationVar(&c.Outbox.PollInterval, "outbox.poll_interval", c.Outbox.PollInterval, "how often the outbox relay looks for events it wasn't told about")
+	fs.IntVar(&c.Outbox.BatchSize, "outbox.batch_size", c.Outbox.BatchSize, "events the outbox relay reads at once")
+	fs.DurationVar(&c.Outbox.MinBackoff, "outbox.min_backoff", c.Outbox.MinBackoff, "first wait after failing to publish, doubled by every further failure")
+	fs.DurationVar(&c.Outbox.MaxBackoff, "outbox.max_backoff", c.Outbox.MaxBackoff, "longest wait between attempts to publish")
+
+	fs.DurationVar(&c.WebSocket.WriteWait, "websocket.write_wait", c.WebSocket.WriteWait, "time allowed to write a message to a peer")
+	fs.DurationVar(&c.WebSocket.PongWait, "websocket.pong_wait", c.WebSocket.PongWait, "time allowed to read the next pong from a peer")
+	fs.DurationVar(&c.WebSocket.PingPeriod, "websocket.ping_period", c.WebSocket.PingPeriod, "how often peers are pinged, less than pong_wait")
+	fs.Int64Var(&c.WebSocket.MaxMessageSize, "websocket.max_message_size", c.WebSocket.MaxMessageSize, "largest message accepted from a peer, in bytes")
+	fs.IntVar(&c.WebSocket.ReadBufferSize, "websocket.read_buffer_size", c.WebSocket.ReadBufferSize, "read buffer per connection, in bytes")
+	fs.IntVar(&c.WebSocket.WriteBufferSize, "websocket.write_buffer_size", c.WebSocket.WriteBufferSize, "write buffer per connection, in bytes")
+
+	fs.StringVar(&c.Log.Level, "log.level", c.Log.Level, "lowest level logged: debug, info, warn or error")
+	fs.Var((*listValue)(&c.Log.RedactFields), "log.redact_fields", "comma separated JSON members kept out of the access log besides password and tokens")
+
+	fs.StringVar(&c.Mail.Kind, "mail.kind", c.Mail.Kind, "how mail is sent: smtp, or outbox to write it to mail.outbox_path")
+	fs.StringVar(&c.Mail.From, "mail.from", c.Mail.From, "sender of mail to users")
+	fs.StringVar(&c.Mail.OutboxPath, "mail.outbox_path", c.Mail.OutboxPath, "file the outbox appends mail to, empty to keep it in memory")
+	fs.StringVar(&c.Mail.SMTP.Addr, "mail.smtp.addr", c.Mail.SMTP.Addr, "SMTP relay host:port")
+	fs.StringVar(&c.Mail.SMTP.Username, "mail.smtp.username", c.Mail.SMTP.Username, "SMTP username, empty for no authentication")
+	fs.StringVar(&c.Mail.SMTP.Password, "mail.smtp.password", c.Mail.SMTP.Password, "SMTP password")
+	fs.BoolVar(&c.Mail.VerifyEmail, "mail.verify_email", c.Mail.VerifyEmail, "require users to verify their email address")
+
+	fs.StringVar(&c.EmailTokens.Secret, "email_tokens.secret", c.EmailTokens.Secret, "HMAC key of mailed links, random per start when empty")
+	fs.DurationVar(&c.EmailTokens.VerifyTTL, "email_tokens.verify_ttl", c.EmailTokens.VerifyTTL, "lifetime of email verification links")
+	fs.DurationVar(&c.EmailTokens.ResetTTL, "email_tokens.reset_ttl", c.EmailTokens.ResetTTL, "lifetime of password reset tokens")
+
+	fs.Float64Var(&c.RateLimit.IP.Rate, "rate_limit.ip.rate", c.RateLimit.IP.Rate, "requests per second per client address, 0 for no limit")
+	fs.IntVar(&c.RateLimit.IP.Burst, "rate_limit.ip.burst", c.RateLimit.IP.Burst, "requests a client address can make at once")
+	fs.Float64Var(&c.RateLimit.Email.Rate, "rate_limit.email.rate", c.RateLimit.Email.Rate, "requests per second per account on auth endpoints, 0 for no limit")
+	fs.IntVar(&c.RateLimit.Email.Burst, "rate_limit.email.burst", c.RateLimit.Email.Burst, "requests at once per account on auth endpoints")
+	fs.IntVar(&c.RateLimit.Lockout.Threshold, "rate_limit.lockout.threshold", c.RateLimit.Lockout.Threshold, "consecutive failed logins that lock an account, 0 for never")
+	fs.DurationVar(&c.RateLimit.Lockout.Duration, "rate_limit.lockout.duration", c.RateLimit.Lockout.Duration, "first lockout, doubled by every further failure")
+	fs.DurationVar(&c.RateLimit.Lockout.MaxDuration, "rate_limit.lockout.max_duration", c.RateLimit.Lockout.MaxDuration, "longest lockout")
+	return fs
+}
+
+func envName(setting string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(setting, ".", "_"))
+}
+
+// listValue is a comma separated flag.Value.
+type listValue []string
+
+func (l *listValue) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *listValue) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// ConfigError lists everything wrong with a configuration at once.
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e.Problems, "\n  ")
+}
+
+func (c Config) Validate() error {
+	var problems []string
+	add := func(setting, format string, args ...interface{}) {
+		problems = append(problems, setting+": "+fmt.Sprintf(format, args...))
+	}
+
+	if c.Server.Addr == "" {
+		add("server.addr", "must not be empty")
+	}
+	if c.Server.DrainDelay < 0 {
+		add("server.drain_delay", "must not be negative")
+	}
+	if c.Server.ShutdownTimeout <= 0 {
+		add("server.shutdown_timeout", "must be positive")
+	}
+
+	if u, err := url.Parse(c.Server.PublicURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		add("server.public_url", "must be an absolute http or https URL, got %q", c.Server.PublicURL)
+	}
+	tls := c.Server.TLS
+	if tls.Enabled() != (tls.KeyFile != "") {
+		add("server.tls", "cert_file and key_file go together")
+	}
+	switch tls.ClientAuth {
+	case clientAuthNone:
+	case clientAuthOptional, clientAuthRequire:
+		if tls.ClientCAFile == "" {
+			add("server.tls.client_ca_file", "must be set for client_auth %s", tls.ClientAuth)
+		}
+	default:
+		add("server.tls.client_auth", "must be none, optional or require, got %q", tls.ClientAuth)
+	}
+	if !tls.Enabled() && (tls.ClientCAFile != "" || tls.ClientAuth != clientAuthNone || tls.RedirectAddr != "") {
+		add("server.tls", "client certificates and the redirect need cert_file")
+	}
+	if tls.RedirectAddr != "" && tls.RedirectAddr == c.Server.Addr {
+		add("server.tls.redirect_addr", "must differ from server.addr")
+	}
+
+	switch c.Storage.Kind {
+	case "memory":
+	case "file", "sqlite":
+		if c.Storage.Path == "" {
+			add("storage.path", "must not be empty for %s storage", c.Storage.Kind)
+		}
+	default:
+		add("storage.kind", "must be memory, file or sqlite, got %q", c.Storage.Kind)
+	}
+
+	if c.JWT.PrivateKeyPath == "" {
+		add("jwt.private_key", "must not be empty")
+	}
+	if c.JWT.PublicKeyPath == "" {
+		add("jwt.public_key", "must not be empty")
+	}
+	if c.JWT.AccessTTL <= 0 {
+		add("jwt.access_ttl", "must be positive")
+	}
+	if c.JWT.RefreshTTL <= c.JWT.AccessTTL {
+		add("jwt.refresh_ttl", "must be longer than jwt.access_ttl")
+	}
+	if c.JWT.RotationInterval < 0 {
+		add("jwt.rotation_interval", "must not be negative")
+	}
+	if c.JWT.GracePeriod < c.JWT.AccessTTL {
+		// Otherwise tokens signed just before a rotation stop verifying
+		// before they expire.
+		add("jwt.grace_period", "must be at least jwt.access_ttl")
+	}
+
+	if c.AMQP.Enabled {
+		if err := c.AMQP.Config.Validate(); err != nil {
+			add("amqp", "%v", err)
+		}
+	}
+	if c.Outbox.PollInterval <= 0 {
+		add("outbox.poll_interval", "must be positive")
+	}
+	if c.Outbox.BatchSize < 1 {
+		add("outbox.batch_size", "must be at least 1")
+	}
+	if c.Outbox.MinBackoff <= 0 || c.Outbox.MaxBackoff < c.Outbox.MinBackoff {
+		add("outbox", "min_backoff must be positive and at most max_backoff")
+	}
+	if err := c.WebSocket.Validate(); err != nil {
+		add("websocket", "%v", err)
+	}
+	if _, err := ParseLogLevel(c.Log.Level); err != nil {
+		add("log.level", "%v", err)
+	}
+
+	switch c.Mail.Kind {
+	case "outbox":
+	case "smtp":
+		if _, _, err := net.SplitHostPort(c.Mail.SMTP.Addr); err != nil {
+			add("mail.smtp.addr", "must be host:port, got %q", c.Mail.SMTP.Addr)
+		}
+	default:
+		add("mail.kind", "must be smtp or outbox, got %q", c.Mail.Kind)
+	}
+	if _, err := mail.ParseAddress(c.Mail.From); err != nil {
+		add("mail.from", "%v", err)
+	}
+	if c.EmailTokens.Secret != "" && len(c.EmailTokens.Secret) < 32 {
+		add("email_tokens.secret", "must be at least 32 characters")
+	}
+	if c.EmailTokens.VerifyTTL <= 0 {
+		add("email_tokens.verify_ttl", "must be positive")
+	}
+	if c.EmailTokens.ResetTTL <= 0 {
+		add("email_tokens.reset_ttl", "must be positive")
+	}
+
+	rates := []struct {
+		name string
+		RateConfig
+	}{{"ip", c.RateLimit.IP}, {"email", c.RateLimit.Email}}
+	for _, rate := range rates {
+		if rate.Rate < 0 {
+			add("rate_limit."+rate.name+".rate", "must not be negative")
+		}
+		if rate.Rate > 0 && rate.Burst < 1 {
+			add("rate_limit."+rate.name+".burst", "must be at least 1")
+		}
+	}
+	if lockout := c.RateLimit.Lockout; lockout.Threshold < 0 {
+		add("rate_limit.lockout.threshold", "must not be negative")
+	} else if lockout.Threshold > 0 && (lockout.Duration <= 0 || lockout.MaxDuration < lockout.Duration) {
+		add("rate_limit.lockout", "duration must be positive and at most max_duration")
+	}
+
+	if len(problems) > 0 {
+		return &ConfigError{Problems: problems}
+	}
+	return nil
+}
+
+var errUnknownLogLevel = errors.New("must be debug, info, warn or error")
+
+func ParseLogLevel(level string) (LogLevel, error) {
+	for _, l := range []LogLevel{LevelDebug, LevelInfo, LevelWarn, LevelError} {
+		if strings.EqualFold(level, l.String()) {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("%w, got %q", errUnknownLogLevel, level)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Handlers report failures with, or by wrapping, one of these errors;
+// handleError turns them into the matching HTTP status.
+var (
+	ErrBadRequest   = errors.New("bad request")
+	ErrValidation   = errors.New("validation failed")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+	ErrUserNotFound = errors.New("The user doesn't exist")
+	ErrUserExists   = errors.New("The user already exists")
+
+	ErrTooManyRequests = errors.New("too many requests")
+)
+
+// kindError is a message shown as is to the client that still matches its
+// kind with errors.Is.
+type kindError struct {
+	kind error
+	msg  string
+}
+
+func newError(kind error, msg string) error {
+	return &kindError{kind: kind, msg: msg}
+}
+
+func (e *kindError) Error() string {
+	return e.msg
+}
+
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+// RetryAfterError is a failure that goes away by itself; handleError tells the
+// client when to try again in the Retry-After header.
+type RetryAfterError struct {
+	Err   error
+	After time.Duration
+}
+
+func (e *RetryAfterError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RetryAfterError) Unwrap() error {
+	return e.Err
+}
+
+// ValidationError tells which request field is invalid and why.
+type ValidationError struct {
+	Field string
+	Err   error
+}
+
+func newValidationError(field, msg string) error {
+	return &ValidationError{Field: field, Err: errors.New(msg)}
+}
+
+func (e *ValidationError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrValidation
+}
+
+// ValidationErrors collects every invalid field of a request.
+type ValidationErrors []*ValidationError
+
+func (e ValidationErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (e ValidationErrors) Is(target error) bool {
+	return target == ErrValidation
+}
+
+// errOrNil keeps an empty ValidationErrors from turning into a non-nil error.
+func (e ValidationErrors) errOrNil() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Problem is an RFC 7807 problem details document.
+type Problem struct {
+	Type      string              `json:"type"`
+	Title     string              `json:"title"`
+	Status    int                 `json:"status"`
+	Detail    string              `json:"detail,omitempty"`
+	Instance  string              `json:"instance,omitempty"`
+	Errors    map[string][]string `json:"errors,omitempty"`
+	RequestID string              `json:"request_id,omitempty"`
+}
+
+type problemKind struct {
+	kind   error
+	slug   string
+	status int
+}
+
+// problemKinds is checked in order, the first kind err matches wins.
+var problemKinds = []problemKind{
+	{ErrBadRequest, "bad-request", http.StatusBadRequest},
+	{ErrUnauthorized, "unauthorized", http.StatusUnauthorized},
+	{ErrUserBanned, "user-banned", http.StatusForbidden},
+	{ErrEmailUnverified, "email-unverified", http.StatusForbidden},
+	{ErrForbidden, "forbidden", http.StatusForbidden},
+	{ErrUserNotFound, "user-not-found", http.StatusNotFound},
+	{ErrUserExists, "user-exists", http.StatusConflict},
+	{ErrValidation, "validation-error", http.StatusUnprocessableEntity},
+	{ErrTooManyRequests, "too-many-requests", http.StatusTooManyRequests},
+}
+
+func errorStatus(err error) int {
+	return newProblem(err).Status
+}
+
+func newProblem(err error) Problem {
+	for _, k := range problemKinds {
+		if errors.Is(err, k.kind) {
+			return Problem{
+				Type:   "/problems/" + k.slug,
+				Title:  http.StatusText(k.status),
+				Status: k.status,
+				Detail: err.Error(),
+				Errors: fieldErrors(err),
+			}
+		}
+	}
+	return Problem{
+		Type:   "/problems/internal-error",
+		Title:  http.StatusText(http.StatusInternalServerError),
+		Status: http.StatusInternalServerError,
+	}
+}
+
+func fieldErrors(err error) map[string][]string {
+	var all ValidationErrors
+	var one *ValidationError
+	switch {
+	case errors.As(err, &all):
+	case errors.As(err, &one):
+		all = ValidationErrors{one}
+	default:
+		return nil
+	}
+	fields := make(map[string][]string)
+	for _, e := range all {
+		fields[e.Field] = append(fields[e.Field], e.Error())
+	}
+	return fields
+}
+
+// handleError writes err as an application/problem+json document. Anything
+// not recognised is an internal failure: it is logged and its details are
+// kept from the client. r may be nil when the request isn't at hand.
+func handleError(err error, w http.ResponseWriter, r *http.Request) {
+	problem := newProblem(err)
+	if problem.Status == http.StatusInternalServerError {
+		logger.Error("internal error", Fields{"error": err})
+	}
+	if r != nil {
+		problem.Instance = r.URL.Path
+		problem.RequestID = requestID(r)
+	}
+	if problem.Status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	var retry *RetryAfterError
+	if errors.As(err, &retry) {
+		// Whole seconds, rounded up so that a client waiting that long
+		// isn't turned away again.
+		seconds := int64((retry.After + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	}
+	out, _ := json.Marshal(problem)
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(problem.Status)
+	w.Write(out)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestErrorStatus(t *testing.T) {
+	cases := map[error]int{
+		newError(ErrBadRequest, "could not read params"): 400,
+		ErrInvalidLogin:                            401,
+		ErrRefreshTokenReused:                      401,
+		ErrForbidden:                               403,
+		Ban{Reason: "spam"}.Err():                  403,
+		ErrUserNotFound:                            404,
+		fmt.Errorf("rekey: %w", ErrUserExists):     409,
+		newValidationError("email", "missing '@'"): 422,
+		errors.New("disk I/O error"):               500,
+	}
+	for err, status := range cases {
+		if got := errorStatus(err); got != status {
+			t.Errorf("errorStatus(%q) = %d; want %d", err, got, status)
+		}
+	}
+}
+
+func TestHandleErrorHidesInternalErrors(t *testing.T) {
+	rec := httptest.NewRecorder()
+	handleError(errors.New("disk I/O error"), rec, httptest.NewRequest(http.MethodGet, "/user/me", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d; want 500", rec.Code)
+	}
+	if strings.Contains(rec.Body.String(), "disk") {
+		t.Errorf("body = %q; want no internal details", rec.Body.String())
+	}
+}
+
+func TestRegisterStatuses(t *testing.T) {
+	doRequest := createRequester(t)
+	us := newTestUserService()
+	ts := httptest.NewServer(http.HandlerFunc(us.Register))
+	defer ts.Close()
+
+	params := map[string]interface{}{
+		"email":         "email@gmail.com",
+		"password":      "qwerty123",
+		"favorite_cake": "citrus",
+	}
+	resp := doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+	assertStatus(t, 201, resp)
+	resp = doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+	assertStatus(t, 409, resp)
+	assertProblem(t, 409, "The user already exists", resp)
+
+	resp = doRequest(http.NewRequest(http.MethodPost, ts.URL, nil))
+	assertStatus(t, 400, resp)
+}
+
+func TestProblemDocument(t *testing.T) {
+	doRequest := createRequester(t)
+	us := newTestUserService()
+	ts := httptest.NewServer(withRequestID(http.HandlerFunc(us.Register)))
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "application/problem+json" {
+		t.Errorf("Content-Type = %s; want application/problem+json", ct)
+	}
+
+	params := map[string]interface{}{
+		"email":         "email",
+		"password":      "1234",
+		"favorite_cake": "citrus",
+	}
+	request, err := http.NewRequest(http.MethodPost, ts.URL+"/user/register", prepareParams(t, params))
+	request.Header.Set("X-Request-ID", "req-1")
+	resp := doRequest(request, err)
+	assertStatus(t, 422, resp)
+	var problem Problem
+	if err := json.Unmarshal(resp.body, &problem); err != nil {
+		t.Fatal(err)
+	}
+	if problem.Type != "/problems/validation-error" || problem.Title != "Unprocessable Entity" ||
+		problem.Instance != "/user/register" || problem.RequestID != "req-1" {
+		t.Errorf("unexpected problem: %+v", problem)
+	}
+	if len(problem.Errors["email"]) != 1 || len(problem.Errors["password"]) != 1 {
+		t.Errorf("errors = %v; want email and password", problem.Errors)
+	}
+	if _, ok := problem.Errors["favorite_cake"]; ok {
+		t.Errorf("errors = %v; want favorite_cake valid", problem.Errors)
+	}
+}
+
+func TestUnauthorizedProblem(t *testing.T) {
+	doRequest := createRequester(t)
+	us := newTestUserService()
+	j, err := NewJWTService(DefaultConfig().JWT)
+	if err != nil {
+		t.FailNow()
+	}
+	ts := httptest.NewServer(j.AuthenticationJWT(us.repository, us.GetCake))
+	defer ts.Close()
+
+	resp := doRequest(http.NewRequest(http.MethodGet, ts.URL, nil))
+	assertStatus(t, 401, resp)
+	assertProblem(t, 401, "unauthorized", resp)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang-api/RabbitMQ"
+)
+
+// Event types, also the routing keys on the events exchange.
+const (
+	EventUserRegistered      = "user.registered"
+	EventUserCakeChanged     = "user.cake_changed"
+	EventUserEmailChanged    = "user.email_changed"
+	EventUserPasswordChanged = "user.password_changed"
+)
+
+// amqpPublishTimeout bounds the wait for the broker to confirm an event.
+const amqpPublishTimeout = 10 * time.Second
+
+// eventVersion is bumped when the data of an event type changes in a way
+// consumers can't ignore.
+const eventVersion = 1
+
+// Event is the envelope every domain event is published in.
+type Event struct {
+	ID         string      `json:"id"`
+	Type       string      `json:"type"`
+	Version    int         `json:"version"`
+	OccurredAt time.Time   `json:"occurred_at"`
+	RequestID  string      `json:"request_id,omitempty"`
+	Data       interface{} `json:"data"`
+}
+
+type UserRegistered struct {
+	Email        string `json:"email"`
+	FavoriteCake string `json:"favorite_cake"`
+}
+
+type UserCakeChanged struct {
+	Email        string `json:"email"`
+	FavoriteCake string `json:"favorite_cake"`
+	Previous     string `json:"previous"`
+}
+
+type UserEmailChanged struct {
+	OldEmail string `json:"old_email"`
+	NewEmail string `json:"new_email"`
+}
+
+type UserPasswordChanged struct {
+	Email string `json:"email"`
+	// Reason is update for a change by the user, reset for one by mail.
+	Reason string `json:"reason"`
+}
+
+// UnmarshalJSON keeps Data encoded, so that an event read back from the
+// outbox is published as it was stored.
+func (e *Event) UnmarshalJSON(b []byte) error {
+	type plain Event
+	var decoded struct {
+		plain
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		return err
+	}
+	*e = Event(decoded.plain)
+	e.Data = decoded.Data
+	return nil
+}
+
+func newEvent(r *http.Request, eventType string, data interface{}) (Event, error) {
+	id, err := randomToken()
+	if err != nil {
+		return Event{}, err
+	}
+	return Event{
+		ID:         id,
+		Type:       eventType,
+		Version:    eventVersion,
+		OccurredAt: time.Now().UTC(),
+		RequestID:  requestID(r),
+		Data:       data,
+	}, nil
+}
+
+// EventPublisher announces changes to users. Implementations must be safe
+// for concurrent use.
+type EventPublisher interface {
+	Publish(ctx context.Context, event Event) error
+}
+
+// NopEventPublisher drops every event, for when nobody listens.
+type NopEventPublisher struct{}
+
+func (NopEventPublisher) Publish(context.Context, Event) error { return nil }
+
+// InMemoryEventPublisher keeps the events published, for tests.
+type InMemoryEventPublisher struct {
+	lock   sync.Mutex
+	events []Event
+}
+
+func (p *InMemoryEventPublisher) Publish(ctx context.Context, event Event) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.events = append(p.events, event)
+	return nil
+}
+
+// Events returns what was published so far, oldest first.
+func (p *InMemoryEventPublisher) Events() []Event {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]Event(nil), p.events...)
+}
+
+var (
+	amqpPublishesTotal = metrics.NewCounterVec(
+		"amqp_publishes_total",
+		"Messages published to RabbitMQ, by worker and whether the broker confirmed them.",
+		"worker", "result",
+	)
+	amqpPublishDuration = metrics.NewHistogramVec(
+		"amqp_publish_duration_seconds",
+		"Time from publishing a message to its confirmation, by worker.",
+		defaultBuckets,
+		"worker",
+	)
+)
+
+// observeAMQPPublish records a publish of a RabbitMQ.WorkerPool worker.
+func observeAMQPPublish(worker int, took time.Duration, err error) {
+	id := strconv.Itoa(worker)
+	result := "confirmed"
+	if err != nil {
+		result = "failed"
+	}
+	amqpPublishesTotal.Inc(id, result)
+	amqpPublishDuration.Observe(took.Seconds(), id)
+}
+
+// AMQPEventPublisher publishes events as JSON to the events exchange. An
+// event counts as published once the broker confirmed it.
+type AMQPEventPublisher struct {
+	publisher *RabbitMQ.WorkerPool
+}
+
+func NewAMQPEventPublisher(publisher *RabbitMQ.WorkerPool) *AMQPEventPublisher {
+	return &AMQPEventPublisher{publisher: publisher}
+}
+
+func (p *AMQPEventPublisher) Publish(ctx context.Context, event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, amqpPublishTimeout)
+	defer cancel()
+	return p.publisher.Publish(ctx, RabbitMQ.NewEvent(event.Type, event.ID, body, event.RequestID))
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestUserServiceStoresEvents(t *testing.T) {
+	doRequest := createRequester(t)
+	us := newTestUserService()
+	j, err := NewJWTService(DefaultConfig().JWT)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/user/register", us.Register)
+	mux.HandleFunc("/user/favorite_cake", j.AuthenticationJWT(us.repository, us.UpdateCake))
+	mux.HandleFunc("/user/email", j.AuthenticationJWT(us.repository, us.UpdateEmail))
+	mux.HandleFunc("/user/password", j.AuthenticationJWT(us.repository, us.UpdatePassword))
+	ts := httptest.NewServer(withRequestID(mux))
+	defer ts.Close()
+
+	params := map[string]interface{}{
+		"email":         "cake@mail.com",
+		"password":      "cakepass",
+		"favorite_cake": "cheesecake",
+	}
+	assertStatus(t, 201, doRequest(http.NewRequest(http.MethodPost, ts.URL+"/user/register", prepareParams(t, params))))
+
+	put := func(path, email string, params map[string]interface{}) {
+		user, _ := us.repository.Get(email)
+		token, _ := j.GenearateJWT(user)
+		request, err := http.NewRequest(http.MethodPut, ts.URL+path, prepareParams(t, params))
+		request.Header.Set("Authorization", "Bearer "+token)
+		request.Header.Set(requestIDHeader, "req-"+path[len("/user/"):])
+		assertStatus(t, 200, doRequest(request, err))
+	}
+	put("/user/favorite_cake", "cake@mail.com", map[string]interface{}{"favorite_cake": "pie"})
+	put("/user/email", "cake@mail.com", map[string]interface{}{"email": "pie@mail.com"})
+	put("/user/password", "pie@mail.com", map[string]interface{}{"password": "piepass1"})
+
+	published, _ := us.repository.Pending(10)
+	want := []struct {
+		eventType string
+		requestID string
+		data      interface{}
+	}{
+		{EventUserRegistered, "", UserRegistered{Email: "cake@mail.com", FavoriteCake: "cheesecake"}},
+		{EventUserCakeChanged, "req-favorite_cake", UserCakeChanged{Email: "cake@mail.com", FavoriteCake: "pie", Previous: "cheesecake"}},
+		{EventUserEmailChanged, "req-email", UserEmailChanged{OldEmail: "cake@mail.com", NewEmail: "pie@mail.com"}},
+		{EventUserPasswordChanged, "req-password", UserPasswordChanged{Email: "pie@mail.com", Reason: "update"}},
+	}
+	if len(published) != len(want) {
+		t.Fatalf("published %d events, want %d: %+v", len(published), len(want), published)
+	}
+	ids := make(map[string]bool)
+	for i, w := range want {
+		event := published[i]
+		if event.Type != w.eventType || event.Version != eventVersion || !reflect.DeepEqual(event.Data, w.data) {
+			t.Errorf("event %d = %+v, want %s %+v", i, event, w.eventType, w.data)
+		}
+		if w.requestID != "" && event.RequestID != w.requestID {
+			t.Errorf("event %d request ID = %q, want %q", i, event.RequestID, w.requestID)
+		}
+		if event.ID == "" || ids[event.ID] || event.OccurredAt.IsZero() {
+			t.Errorf("event %d lacks a unique ID or time: %+v", i, event)
+		}
+		ids[event.ID] = true
+	}
+}
+
+func TestEventEnvelope(t *testing.T) {
+	request := httptest.NewRequest(http.MethodPut, "/user/favorite_cake", nil)
+	request = request.WithContext(contextWithRequestID(request.Context(), "abc"))
+	event, err := newEvent(request, EventUserCakeChanged, UserCakeChanged{Email: "cake@mail.com", FavoriteCake: "pie"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := json.Marshal(event)
+	var envelope map[string]interface{}
+	json.Unmarshal(body, &envelope)
+	for _, field := range []string{"id", "type", "version", "occurred_at", "request_id", "data"} {
+		if _, ok := envelope[field]; !ok {
+			t.Errorf("envelope lacks %q: %s", field, body)
+		}
+	}
+	data, _ := envelope["data"].(map[string]interface{})
+	if data["favorite_cake"] != "pie" || envelope["version"] != float64(1) || envelope["request_id"] != "abc" {
+		t.Errorf("unexpected envelope: %s", body)
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+const (
+	logOpPut    = "put"
+	logOpDelete = "delete"
+	logOpRekey  = "rekey"
+	// logOpOutbox only carries events, as snapshots do for the pending ones.
+	logOpOutbox    = "outbox"
+	logOpDelivered = "delivered"
+
+	// The log is compacted once it holds compactionRatio times more records
+	// than there are users, but never below compactionMinRecords records.
+	compactionRatio      = 2
+	compactionMinRecords = 1000
+)
+
+// logRecord is one line of the append-only log, written as
+// "<crc32 of json> <json>\n" so that a torn write can be told apart from data.
+// Events ride along with the change they announce; a delivered record names
+// the event in Key.
+type logRecord struct {
+	Op     string  `json:"op"`
+	Key    string  `json:"key"`
+	NewKey string  `json:"new_key,omitempty"`
+	User   *User   `json:"user,omitempty"`
+	Events []Event `json:"events,omitempty"`
+}
+
+// FileUserStorage keeps users in memory and makes every change durable by
+// appending it to a log file, fsynced before the change becomes visible. The
+// log is replayed on startup and periodically compacted into a snapshot.
+type FileUserStorage struct {
+	lock    sync.RWMutex
+	path    string
+	file    *os.File
+	size    int64
+	records int
+	storage map[string]User
+	outbox  memoryOutbox
+}
+
+func NewFileUserStorage(path string) (*FileUserStorage, error) {
+	repository := &FileUserStorage{
+		path:    path,
+		storage: make(map[string]User),
+	}
+	if err := repository.load(); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	repository.file = file
+	repository.size = info.Size()
+	return repository, nil
+}
+
+// load replays the log. An incomplete last record is what a crash in the
+// middle of an append leaves behind, so it is cut off; a damaged record
+// anywhere else means the file is corrupt and loading fails.
+func (repository *FileUserStorage) load() error {
+	file, err := os.OpenFile(repository.path, os.O_RDWR, 0600)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(data) > 0 {
+				return file.Truncate(offset)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		record, err := decodeLogRecord(data)
+		if err != nil {
+			if _, peekErr := reader.Peek(1); peekErr == io.EOF {
+				return file.Truncate(offset)
+			}
+			return fmt.Errorf("%s: line %d: %w", repository.path, line, err)
+		}
+		repository.apply(record)
+		offset += int64(len(data))
+	}
+}
+
+func (repository *FileUserStorage) apply(record logRecord) {
+	repository.records++
+	switch record.Op {
+	case logOpPut:
+		repository.storage[record.Key] = *record.User
+	case logOpDelete:
+		delete(repository.storage, record.Key)
+	case logOpRekey:
+		delete(repository.storage, record.Key)
+		repository.storage[record.NewKey] = *record.User
+	case logOpDelivered:
+		repository.outbox.delivered(record.Key)
+	}
+	repository.outbox = append(repository.outbox, record.Events...)
+}
+
+func (repository *FileUserStorage) Add(key string, usr User, events ...Event) error {
+	repository.lock.Lock()
+	defer repository.lock.Unlock()
+	if _, ok := repository.storage[key]; ok {
+		return ErrUserExists
+	}
+	return repository.commit(logRecord{Op: logOpPut, Key: key, User: &usr, Events: events})
+}
+
+func (repository *FileUserStorage) Update(key string, usr User, events ...Event) error {
+	repository.lock.Lock()
+	defer repository.lock.Unlock()
+	if _, ok := repository.storage[key]; !ok {
+		return ErrUserNotFound
+	}
+	return repository.commit(logRecord{Op: logOpPut, Key: key, User: &usr, Events: events})
+}
+
+func (repository *FileUserStorage) Modify(key string, change func(usr *User) ([]Event, error)) (User, error) {
+	repository.lock.Lock()
+	defer repository.lock.Unlock()
+	usr, ok := repository.storage[key]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	events, err := change(&usr)
+	if err != nil {
+		return User{}, err
+	}
+	if err := repository.commit(logRecord{Op: logOpPut, Key: key, User: &usr, Events: events}); err != nil {
+		return User{}, err
+	}
+	return usr, nil
+}
+
+func (repository *FileUserStorage) Get(key string) (User, error) {
+	repository.lock.RLock()
+	defer repository.lock.RUnlock()
+	usr, ok := repository.storage[key]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	return usr, nil
+}
+
+func (repository *FileUserStorage) Delete(key string) (User, error) {
+	repository.lock.Lock()
+	defer repository.lock.Unlock()
+	usr, ok := repository.storage[key]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	if err := repository.commit(logRecord{Op: logOpDelete, Key: key}); err != nil {
+		return User{}, err
+	}
+	return usr, nil
+}
+
+// Rekey is a single record in the log, so a crash can't leave the user
+// under both keys or under neither.
+func (repository *FileUserStorage) Rekey(oldKey, newKey string, change func(usr *User) ([]Event, error)) (User, error) {
+	repository.lock.Lock()
+	defer repository.lock.Unlock()
+	usr, ok := repository.storage[oldKey]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	if _, ok := repository.storage[newKey]; ok && newKey != oldKey {
+		return User{}, ErrUserExists
+	}
+	events, err := change(&usr)
+	if err != nil {
+		return User{}, err
+	}
+	if err := repository.commit(logRecord{Op: logOpRekey, Key: oldKey, NewKey: newKey, User: &usr, Events: events}); err != nil {
+		return User{}, err
+	}
+	return usr, nil
+}
+
+func (repository *FileUserStorage) Pending(limit int) ([]Event, error) {
+	repository.lock.RLock()
+	defer repository.lock.RUnlock()
+	return repository.outbox.pending(limit), nil
+}
+
+func (repository *FileUserStorage) PendingCount() (int, error) {
+	repository.lock.RLock()
+	defer repository.lock.RUnlock()
+	return len(repository.outbox), nil
+}
+
+func (repository *FileUserStorage) Delivered(id string) error {
+	repository.lock.Lock()
+	defer repository.lock.Unlock()
+	for _, event := range repository.outbox {
+		if event.ID == id {
+			return repository.commit(logRecord{Op: logOpDelivered, Key: id})
+		}
+	}
+	return nil
+}
+
+func (repository *FileUserStorage) Count() (int, error) {
+	repository.lock.RLock()
+	defer repository.lock.RUnlock()
+	return len(repository.storage), nil
+}
+
+func (repository *FileUserStorage) List(prefix string, offset, limit int) ([]User, int, error) {
+	repository.lock.RLock()
+	defer repository.lock.RUnlock()
+	users, total := listUsers(repository.storage, prefix, offset, limit)
+	return users, total, nil
+}
+
+// Compact rewrites the log as a snapshot holding a single record per user.
+func (repository *FileUserStorage) Compact() error {
+	repository.lock.Lock()
+	defer repository.lock.Unlock()
+	return repository.compact()
+}
+
+func (repository *FileUserStorage) Close() error {
+	repository.lock.Lock()
+	defer repository.lock.Unlock()
+	return repository.file.Close()
+}
+
+// commit makes the record durable and only then applies it in memory.
+// Callers hold the write lock.
+func (repository *FileUserStorage) commit(record logRecord) error {
+	data, err := encodeLogRecord(record)
+	if err != nil {
+		return err
+	}
+	_, err = repository.file.Write(data)
+	if err == nil {
+		err = repository.file.Sync()
+	}
+	if err != nil {
+		// Don't leave a partial record for the next one to be appended to.
+		repository.file.Truncate(repository.size)
+		return err
+	}
+	repository.size += int64(len(data))
+	repository.apply(record)
+
+	if repository.records >= compactionMinRecords &&
+		repository.records >= compactionRatio*len(repository.storage) {
+		// The change is already durable; a failed compaction only leaves
+		// a longer log behind.
+		repository.compact()
+	}
+	return nil
+}
+
+// compact writes the snapshot next to the log and renames it over the log,
+// so a crash leaves either the old log or the complete snapshot. The snapshot
+// is opened for appending from the start and becomes the new log handle.
+func (repository *FileUserStorage) compact() error {
+	tmpPath := repository.path + ".compact"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	size, err := repository.writeSnapshot(tmp)
+	if err == nil {
+		err = os.Rename(tmpPath, repository.path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	repository.file.Close()
+	repository.file = tmp
+	repository.size = size
+	repository.records = len(repository.storage)
+	return syncDir(filepath.Dir(repository.path))
+}
+
+func (repository *FileUserStorage) writeSnapshot(file *os.File) (int64, error) {
+	writer := bufio.NewWriter(file)
+	var size int64
+	for key, usr := range repository.storage {
+		usr := usr
+		data, err := encodeLogRecord(logRecord{Op: logOpPut, Key: key, User: &usr})
+		if err != nil {
+			return 0, err
+		}
+		n, _ := writer.Write(data)
+		size += int64(n)
+	}
+	if len(repository.outbox) > 0 {
+		data, err := encodeLogRecord(logRecord{Op: logOpOutbox, Events: repository.outbox})
+		if err != nil {
+			return 0, err
+		}
+		n, _ := writer.Write(data)
+		size += int64(n)
+	}
+	if err := writer.Flush(); err != nil {
+		return 0, err
+	}
+	return size, file.Sync()
+}
+
+func encodeLogRecord(record logRecord) ([]byte, error) {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	line := make([]byte, 0, len(payload)+10)
+	line = append(line, fmt.Sprintf("%08x ", crc32.ChecksumIEEE(payload))...)
+	line = append(line, payload...)
+	return append(line, '\n'), nil
+}
+
+func decodeLogRecord(line []byte) (logRecord, error) {
+	var record logRecord
+	line = bytes.TrimSuffix(line, []byte{'\n'})
+	sep := bytes.IndexByte(line, ' ')
+	if sep < 0 {
+		return record, errors.New("malformed record")
+	}
+	checksum, err := strconv.ParseUint(string(line[:sep]), 16, 32)
+	if err != nil {
+		return record, errors.New("malformed record checksum")
+	}
+	payload := line[sep+1:]
+	if crc32.ChecksumIEEE(payload) != uint32(checksum) {
+		return record, errors.New("record checksum mismatch")
+	}
+	if err := json.Unmarshal(payload, &record); err != nil {
+		return record, err
+	}
+	switch {
+	case record.Op == logOpPut && record.User != nil:
+	case record.Op == logOpDelete:
+	case record.Op == logOpRekey && record.User != nil && record.NewKey != "":
+	case record.Op == logOpOutbox && len(record.Events) > 0:
+	case record.Op == logOpDelivered && record.Key != "":
+	default:
+		return record, fmt.Errorf("unknown record %q", record.Op)
+	}
+	return record, nil
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
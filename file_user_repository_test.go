@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openFileStorage(t *testing.T, path string) *FileUserStorage {
+	userStor, err := NewFileUserStorage(path)
+	if err != nil {
+		t.Fatalf("NewFileUserStorage() = %s; want nil", err)
+	}
+	return userStor
+}
+
+func TestFileStorageSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.log")
+	userStor := openFileStorage(t, path)
+	user := User{
+		Email:          "myemail@gmail.com",
+		PasswordDigest: "QwErTy123",
+		FavoriteCake:   "Orange",
+	}
+	userStor.Add("nick", user)
+	userStor.Add("john", user)
+	user.FavoriteCake = "Lemon"
+	userStor.Update("nick", user)
+	userStor.Delete("john")
+	userStor.Close()
+
+	userStor = openFileStorage(t, path)
+	defer userStor.Close()
+	gotUser, err := userStor.Get("nick")
+	if err != nil {
+		t.Errorf("Get(nick) = %s; want nil", err)
+	}
+	if gotUser != user {
+		t.Errorf("Get(nick) = %v; want %v", gotUser, user)
+	}
+	if _, err := userStor.Get("john"); err == nil {
+		t.Error("Get(john) = nil; want error")
+	}
+	if err := userStor.Add("nick", user); err == nil {
+		t.Error("Add(nick) = nil; want error")
+	}
+}
+
+func TestFileStorageDropsTornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.log")
+	userStor := openFileStorage(t, path)
+	userStor.Add("nick", User{Email: "myemail@gmail.com"})
+	userStor.Close()
+
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	file.Write([]byte(`1234abcd {"op":"put","key":"jo`))
+	file.Close()
+
+	userStor = openFileStorage(t, path)
+	if _, err := userStor.Get("nick"); err != nil {
+		t.Errorf("Get(nick) = %s; want nil", err)
+	}
+	userStor.Add("john", User{Email: "john@gmail.com"})
+	userStor.Close()
+
+	userStor = openFileStorage(t, path)
+	defer userStor.Close()
+	if _, err := userStor.Get("john"); err != nil {
+		t.Errorf("Get(john) after torn record = %s; want nil", err)
+	}
+}
+
+func TestFileStorageRejectsCorruption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.log")
+	userStor := openFileStorage(t, path)
+	userStor.Add("nick", User{Email: "myemail@gmail.com"})
+	userStor.Add("john", User{Email: "john@gmail.com"})
+	userStor.Close()
+
+	data, _ := os.ReadFile(path)
+	data[12] ^= 0xff
+	os.WriteFile(path, data, 0600)
+
+	if _, err := NewFileUserStorage(path); err == nil {
+		t.Error("NewFileUserStorage(corrupt) = nil; want error")
+	}
+}
+
+func TestFileStorageCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.log")
+	userStor := openFileStorage(t, path)
+	user := User{Email: "myemail@gmail.com"}
+	userStor.Add("nick", user)
+	for _, cake := range []string{"Orange", "Lemon", "Cherry"} {
+		user.FavoriteCake = cake
+		userStor.Update("nick", user)
+	}
+	if err := userStor.Compact(); err != nil {
+		t.Fatalf("Compact() = %s; want nil", err)
+	}
+	userStor.Add("john", User{Email: "john@gmail.com"})
+	userStor.Close()
+
+	data, _ := os.ReadFile(path)
+	if lines := bytes.Count(data, []byte{'\n'}); lines != 2 {
+		t.Errorf("log has %d records after compaction; want 2", lines)
+	}
+	userStor = openFileStorage(t, path)
+	defer userStor.Close()
+	gotUser, _ := userStor.Get("nick")
+	if gotUser.FavoriteCake != "Cherry" {
+		t.Errorf("Get(nick).FavoriteCake = %s; want Cherry", gotUser.FavoriteCake)
+	}
+	if _, err := userStor.Get("john"); err != nil {
+		t.Errorf("Get(john) = %s; want nil", err)
+	}
+}
+
+func TestFileStorageRekey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.log")
+	userStor := openFileStorage(t, path)
+	user := User{Email: "myemail@gmail.com"}
+	userStor.Add("nick", user)
+	userStor.Add("john", User{Email: "john@gmail.com"})
+	if _, err := userStor.Rekey("nick", "john", replaceUser(user)); err == nil {
+		t.Error("Rekey(nick, john) = nil; want error")
+	}
+	user.Email = "bob@gmail.com"
+	if _, err := userStor.Rekey("nick", "bob", replaceUser(user)); err != nil {
+		t.Fatalf("Rekey(nick, bob) = %s; want nil", err)
+	}
+	userStor.Close()
+
+	userStor = openFileStorage(t, path)
+	defer userStor.Close()
+	if _, err := userStor.Get("nick"); err == nil {
+		t.Error("Get(nick) = nil; want error")
+	}
+	if gotUser, err := userStor.Get("bob"); err != nil || gotUser != user {
+		t.Errorf("Get(bob) = %v, %v; want %v", gotUser, err, user)
+	}
+}
+
+func TestFileStorageOutbox(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.log")
+	userStor := openFileStorage(t, path)
+	userStor.Add("nick", User{Email: "myemail@gmail.com"}, testEvent("1"))
+	userStor.Update("nick", User{Email: "myemail@gmail.com"}, testEvent("2"), testEvent("3"))
+	userStor.Delivered("1")
+	userStor.Close()
+
+	userStor = openFileStorage(t, path)
+	pending, _ := userStor.Pending(10)
+	if len(pending) != 2 || pending[0].ID != "2" || pending[1].ID != "3" {
+		t.Fatalf("Pending() after restart = %v; want events 2 and 3", pending)
+	}
+	if err := userStor.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	userStor.Delivered("2")
+	userStor.Close()
+
+	userStor = openFileStorage(t, path)
+	defer userStor.Close()
+	pending, _ = userStor.Pending(10)
+	if count, _ := userStor.PendingCount(); count != 1 || pending[0].ID != "3" {
+		t.Errorf("Pending() after compaction = %v; want event 3", pending)
+	}
+}
@@ -3,10 +3,14 @@ module golang-api
 go 1.17
 
 require (
+	github.com/golang-jwt/jwt v3.2.2+incompatible
 	github.com/gorilla/mux v1.8.0
 	github.com/gorilla/websocket v1.4.2
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/openware/rango v0.0.0-20210909144821-b2239c24555b
 	github.com/streadway/amqp v1.0.0
+	golang.org/x/crypto v0.8.0
+	gopkg.in/yaml.v2 v2.2.5
 )
 
-require github.com/golang-jwt/jwt v3.2.2+incompatible // indirect
+require golang.org/x/sys v0.7.0 // indirect
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// healthCheckTimeout bounds a whole readiness probe, all checks run at once.
+const healthCheckTimeout = 2 * time.Second
+
+var errShuttingDown = errors.New("shutting down")
+
+// HealthCheck reports whether a dependency can serve requests.
+type HealthCheck func(ctx context.Context) error
+
+// Health serves the liveness and readiness probes. Readiness runs every
+// registered check; it is also withdrawn once shutdown starts so that load
+// balancers stop routing to us while in-flight requests finish.
+type Health struct {
+	lock         sync.RWMutex
+	checks       map[string]HealthCheck
+	timeout      time.Duration
+	shuttingDown int32
+}
+
+func NewHealth(timeout time.Duration) *Health {
+	return &Health{checks: make(map[string]HealthCheck), timeout: timeout}
+}
+
+func (h *Health) AddCheck(name string, check HealthCheck) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.checks[name] = check
+}
+
+func (h *Health) SetShuttingDown() {
+	atomic.StoreInt32(&h.shuttingDown, 1)
+}
+
+type CheckResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type HealthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+// Check runs every check concurrently and reports whether all of them passed.
+func (h *Health) Check(ctx context.Context) (HealthReport, bool) {
+	h.lock.RLock()
+	names := make([]string, 0, len(h.checks))
+	for name := range h.checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	checks := make([]HealthCheck, len(names))
+	for i, name := range names {
+		checks[i] = h.checks[name]
+	}
+	h.lock.RUnlock()
+
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	errs := make([]error, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check HealthCheck) {
+			defer wg.Done()
+			errs[i] = runCheck(ctx, check)
+		}(i, check)
+	}
+	wg.Wait()
+
+	report := HealthReport{Status: "ready", Checks: make(map[string]CheckResult, len(names))}
+	ready := true
+	for i, name := range names {
+		if errs[i] != nil {
+			ready = false
+			report.Checks[name] = CheckResult{Status: "failing", Error: errs[i].Error()}
+			continue
+		}
+		report.Checks[name] = CheckResult{Status: "ok"}
+	}
+	if atomic.LoadInt32(&h.shuttingDown) == 1 {
+		ready = false
+		report.Checks["shutdown"] = CheckResult{Status: "failing", Error: errShuttingDown.Error()}
+	}
+	if !ready {
+		report.Status = "not_ready"
+	}
+	return report, ready
+}
+
+// runCheck gives up on a check that ignores ctx once ctx is done.
+func runCheck(ctx context.Context, check HealthCheck) error {
+	done := make(chan error, 1)
+	go func() { done <- check(ctx) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Live answers as long as the process serves HTTP at all.
+func (h *Health) Live(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, HealthReport{Status: "ok"})
+}
+
+func (h *Health) Ready(w http.ResponseWriter, r *http.Request) {
+	report, ready := h.Check(r.Context())
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, status, report)
+}
+
+func repositoryCheck(users UserRepository) HealthCheck {
+	return func(ctx context.Context) error {
+		_, err := users.Count()
+		return err
+	}
+}
+
+func signingKeyCheck(j *JWTService) HealthCheck {
+	return func(ctx context.Context) error {
+		if j.keys.SigningKey() == nil {
+			return errors.New("no signing key loaded")
+		}
+		return nil
+	}
+}
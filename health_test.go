@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func probe(t *testing.T, h http.HandlerFunc) (int, HealthReport) {
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	var report HealthReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, report
+}
+
+func TestReadiness(t *testing.T) {
+	j, err := NewJWTService(DefaultConfig().JWT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	health := NewHealth(50 * time.Millisecond)
+	health.AddCheck("user_repository", repositoryCheck(NewInMemoryUserStorage()))
+	health.AddCheck("jwt_keys", signingKeyCheck(j))
+
+	status, report := probe(t, health.Ready)
+	if status != http.StatusOK || report.Status != "ready" || len(report.Checks) != 2 {
+		t.Errorf("got %d %+v; want ready", status, report)
+	}
+
+	health.AddCheck("amqp", func(ctx context.Context) error { return errors.New("connection refused") })
+	health.AddCheck("slow", func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	})
+	status, report = probe(t, health.Ready)
+	if status != http.StatusServiceUnavailable || report.Status != "not_ready" {
+		t.Errorf("got %d %+v; want not ready", status, report)
+	}
+	if report.Checks["amqp"].Error != "connection refused" || report.Checks["slow"].Status != "failing" ||
+		report.Checks["jwt_keys"].Status != "ok" {
+		t.Errorf("unexpected checks: %+v", report.Checks)
+	}
+}
+
+func TestShutdownWithdrawsReadiness(t *testing.T) {
+	health := NewHealth(time.Second)
+	health.SetShuttingDown()
+
+	status, report := probe(t, health.Ready)
+	if status != http.StatusServiceUnavailable || report.Checks["shutdown"].Status != "failing" {
+		t.Errorf("got %d %+v; want not ready", status, report)
+	}
+	if status, report := probe(t, health.Live); status != http.StatusOK || report.Status != "ok" {
+		t.Errorf("liveness: got %d %+v", status, report)
+	}
+}
@@ -1,39 +1,189 @@
 package main
 
 import (
-	"crypto/md5"
+	"context"
+	"github.com/golang-jwt/jwt"
 	"github.com/openware/rango/pkg/auth"
 	"net/http"
 	"encoding/json"
 	"errors"
 	"strings"
+	"time"
 )
+
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
 type JWTService struct {
-	keys *auth.KeyStore
+	keys *Keyring
+	refreshTokens RefreshTokenStore
+	revocations RevocationStore
+	accessTTL time.Duration
+	refreshTTL time.Duration
 }
 
-func NewJWTService(privKeyPath, pubKeyPath string) (*JWTService, error) {
-	keys, err := auth.LoadOrGenerateKeys(privKeyPath, pubKeyPath)
+func NewJWTService(config JWTConfig) (*JWTService, error) {
+	keys, err := auth.LoadOrGenerateKeys(config.PrivateKeyPath, config.PublicKeyPath)
 	if err != nil {
 		return nil, err
 	}
+	if !keys.PrivateKey.PublicKey.Equal(keys.PublicKey) {
+		return nil, errors.New("public key does not match private key")
+	}
+	keyring := NewKeyring(config.GracePeriod)
+	if _, err := keyring.Add(keys.PrivateKey); err != nil {
+		return nil, err
+	}
 
-	return &JWTService{keys: keys}, nil
+	return &JWTService{
+		keys: keyring,
+		refreshTokens: NewInMemoryRefreshTokenStore(),
+		revocations: NewInMemoryRevocationStore(),
+		accessTTL: config.AccessTTL,
+		refreshTTL: config.RefreshTTL,
+	}, nil
 }
 
+// GenearateJWT signs an access token with the current key of the keyring and
+// names that key in the kid header. The claims are the ones auth.ForgeToken
+// produces, so the token still parses as auth.Auth.
 func (j *JWTService) GenearateJWT(u User) (string, error) {
-	return auth.ForgeToken("empty", u.Email, "empty", 0, j.keys.PrivateKey, nil)
+	jti, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+	expiresAt := now.Add(j.accessTTL)
+	claims := jwt.MapClaims{
+		"iat":         now.Unix(),
+		"jti":         jti,
+		"exp":         expiresAt.Unix(),
+		"sub":         "session",
+		"iss":         "barong",
+		"aud":         [2]string{"peatio", "barong"},
+		"uid":         "empty",
+		"email":       u.Email,
+		"role":        string(u.Role.Effective()),
+		"level":       0,
+		"state":       userState(u),
+		"referral_id": nil,
+	}
+	key := j.keys.SigningKey()
+	t := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	t.Header["kid"] = key.ID
+	token, err := t.SignedString(key.PrivateKey)
+	if err != nil {
+		return "", err
+	}
+	j.revocations.Track(u.Email, jti, expiresAt)
+	return token, nil
+}
+
+// userState is the state claim: barong calls accounts that still have to
+// confirm their email pending.
+func userState(u User) string {
+	if u.Unverified {
+		return "pending"
+	}
+	return "active"
+}
+
+// RevokeUser invalidates every access and refresh token issued to the user.
+func (j *JWTService) RevokeUser(email string) {
+	j.revocations.RevokeUser(email)
+	j.refreshTokens.RevokeUser(email)
+}
+
+type TokenPair struct {
+	AccessToken string `json:"access_token"`
+	TokenType string `json:"token_type"`
+	ExpiresIn int64 `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// IssueTokens logs the user in: it returns an access token together with the
+// first refresh token of a new token family.
+func (j *JWTService) IssueTokens(u User) (TokenPair, error) {
+	refreshToken, err := j.refreshTokens.Issue(u.Email, j.refreshTTL)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	return j.tokenPair(u, refreshToken)
+}
+
+// RefreshTokens exchanges a refresh token for a new pair. The presented token
+// can't be used again; replaying it revokes every token issued after it.
+func (j *JWTService) RefreshTokens(refreshToken string, users UserRepository) (TokenPair, error) {
+	next, email, err := j.refreshTokens.Rotate(refreshToken, j.refreshTTL)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	user, err := users.Get(email)
+	if err != nil || user.Ban.Active(time.Now()) {
+		j.refreshTokens.RevokeFamily(email, next)
+		return TokenPair{}, ErrRefreshTokenInvalid
+	}
+	return j.tokenPair(user, next)
+}
+
+func (j *JWTService) tokenPair(u User, refreshToken string) (TokenPair, error) {
+	accessToken, err := j.GenearateJWT(u)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	return TokenPair{
+		AccessToken: accessToken,
+		TokenType: "Bearer",
+		ExpiresIn: int64(j.accessTTL / time.Second),
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+func (j *JWTService) ParseJWT(token string) (auth.Auth, error) {
+	a := auth.Auth{}
+	_, err := jwt.ParseWithClaims(token, &a, j.keys.keyFunc)
+	return a, err
 }
 
-func (j *JWTService) ParseJWT(jwt string) (auth.Auth, error) {
-	return auth.ParseAndValidate(jwt, j.keys.PublicKey)
+// StartKeyRotation rotates the signing key in the background until ctx is done.
+func (j *JWTService) StartKeyRotation(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go j.keys.RunRotation(ctx, interval)
 }
 
+func (j *JWTService) JWKS(w http.ResponseWriter, r *http.Request) {
+	j.keys.ServeJWKS(w, r)
+}
+
+type authContextKey struct{}
+
+// authFromContext returns the claims of the token the request was
+// authenticated with by AuthenticationJWT.
+func authFromContext(ctx context.Context) (auth.Auth, bool) {
+	a, ok := ctx.Value(authContextKey{}).(auth.Auth)
+	return a, ok
+}
+
+// ErrInvalidLogin doesn't tell an unknown email from a wrong password.
+var ErrInvalidLogin = newError(ErrUnauthorized, "invalid login params")
+
 type JWTParams struct {
 	Email string `json:"email"`
 	Password string `json:"password"`
 }
 
+type RefreshParams struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type LogoutParams struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
 func (u *UserService) JWT(
 	w http.ResponseWriter,
 	r *http.Request,
@@ -42,26 +192,95 @@ func (u *UserService) JWT(
 	params := &JWTParams{}
 	err := json.NewDecoder(r.Body).Decode(params)
 	if err != nil {
-		handleError(errors.New("could not read params"), w)
+		handleError(newError(ErrBadRequest, "could not read params"), w, r)
+		return
+	}
+	// A locked account doesn't get its password checked, so guesses made
+	// meanwhile tell nothing.
+	if wait := u.lockout.Locked(params.Email); wait > 0 {
+		loginFailuresTotal.Inc("locked")
+		handleError(&RetryAfterError{Err: ErrAccountLocked, After: wait}, w, r)
 		return
 	}
-	passwordDigest := md5.New().Sum([]byte(params.Password))
 	user, err := u.repository.Get(params.Email)
 	if err != nil {
-		handleError(err, w)
+		loginFailuresTotal.Inc("unknown_user")
+		u.lockout.Fail(params.Email)
+		handleError(ErrInvalidLogin, w, r)
+		return
+	}
+	ok, err := u.hasher.Verify(params.Password, user.PasswordDigest)
+	if err != nil || !ok {
+		loginFailuresTotal.Inc("wrong_password")
+		if lockout := u.lockout.Fail(params.Email); lockout > 0 {
+			logger.Warn("account locked after failed logins", Fields{"user": params.Email, "lockout": lockout.String()})
+		}
+		handleError(ErrInvalidLogin, w, r)
 		return
 	}
-	if string(passwordDigest) != user.PasswordDigest {
-		handleError(errors.New("invalid login params"), w)
+	if user.Ban.Active(time.Now()) {
+		loginFailuresTotal.Inc("banned")
+		handleError(user.Ban.Err(), w, r)
 		return
 	}
-	token, err := jwtService.GenearateJWT(user)
+	if u.hasher.NeedsRehash(user.PasswordDigest) {
+		u.rehashPassword(user, params.Password)
+	}
+	tokens, err := jwtService.IssueTokens(user)
 	if err != nil {
-		handleError(err, w)
+		handleError(err, w, r)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(token))
+	u.lockout.Succeed(params.Email)
+	loginsTotal.Inc()
+	writeTokens(w, tokens)
+}
+
+func (u *UserService) RefreshJWT(
+	w http.ResponseWriter,
+	r *http.Request,
+	jwtService *JWTService,
+) {
+	params := &RefreshParams{}
+	err := json.NewDecoder(r.Body).Decode(params)
+	if err != nil {
+		handleError(newError(ErrBadRequest, "could not read params"), w, r)
+		return
+	}
+	tokens, err := jwtService.RefreshTokens(params.RefreshToken, u.repository)
+	if errors.Is(err, ErrRefreshTokenReused) {
+		logger.Warn("refresh token reuse detected, token family revoked", nil)
+	}
+	if err != nil {
+		handleError(err, w, r)
+		return
+	}
+	writeTokens(w, tokens)
+}
+
+func writeTokens(w http.ResponseWriter, tokens TokenPair) {
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, tokens)
+}
+
+// rehashPassword upgrades a digest made with an outdated algorithm or cost.
+// Failing to do so must not block the login, the old digest stays valid.
+func (u *UserService) rehashPassword(user User, password string) {
+	passwordDigest, err := u.hasher.Hash(password)
+	if err != nil {
+		logger.Error("could not rehash password", Fields{"error": err, "user": user.Email})
+		return
+	}
+	_, err = u.repository.Modify(user.Email, func(stored *User) ([]Event, error) {
+		// A password changed since the login was checked stays.
+		if stored.PasswordDigest == user.PasswordDigest {
+			stored.PasswordDigest = passwordDigest
+		}
+		return nil, nil
+	})
+	if err != nil {
+		logger.Error("could not store rehashed password", Fields{"error": err, "user": user.Email})
+	}
 }
 
 func (j *JWTService) AuthenticationJWT(
@@ -73,16 +292,53 @@ func (j *JWTService) AuthenticationJWT(
 		token := strings.TrimPrefix(header, "Bearer ")
 		auth, err := j.ParseJWT(token)
 		if err != nil {
-			rw.WriteHeader(401)
-			rw.Write([]byte("unauthorized"))
+			tokenValidationFailuresTotal.Inc("invalid")
+			handleError(ErrUnauthorized, rw, r)
+			return
+		}
+		if j.revocations.IsRevoked(auth.Id) {
+			tokenValidationFailuresTotal.Inc("revoked")
+			handleError(ErrUnauthorized, rw, r)
 			return
 		}
 		user, err := users.Get(auth.Email)
 		if err != nil {
-			rw.WriteHeader(401)
-			rw.Write([]byte("unauthorized"))
+			tokenValidationFailuresTotal.Inc("unknown_user")
+			handleError(ErrUnauthorized, rw, r)
+			return
+		}
+		if user.Ban.Active(time.Now()) {
+			tokenValidationFailuresTotal.Inc("banned")
+			handleError(user.Ban.Err(), rw, r)
 			return
 		}
+		setLogUser(r, user.Email)
+		r = r.WithContext(context.WithValue(r.Context(), authContextKey{}, auth))
 		prHandler(rw, r, user)
 	}
 }
+
+// Logout revokes the access token the request was made with and, when given,
+// the refresh token family it came from. A refresh token of someone else is
+// refused, and nothing is revoked then.
+func (j *JWTService) Logout(w http.ResponseWriter, r *http.Request, user User) {
+	params := &LogoutParams{}
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(params)
+		if err != nil {
+			handleError(newError(ErrBadRequest, "could not read params"), w, r)
+			return
+		}
+	}
+	if params.RefreshToken != "" {
+		if err := j.refreshTokens.RevokeFamily(user.Email, params.RefreshToken); err != nil {
+			handleError(err, w, r)
+			return
+		}
+	}
+	if a, ok := authFromContext(r.Context()); ok {
+		j.revocations.Revoke(a.Id, time.Unix(a.ExpiresAt, 0))
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("logged out"))
+}
@@ -2,18 +2,19 @@ package main
 
 import(
 	"testing"
+	"time"
 	// "github.com/openware/rango/pkg/auth"
 )
 
 func TestNewJWTService(t *testing.T) {
-	_, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+	_, err := NewJWTService(DefaultConfig().JWT)
 	if err != nil {
 		t.Errorf("Expected: err = nil; actual err = %s", err)
 	}
 }
 
 func TestNewJWTServiceInvalid(t *testing.T) {
-	jwtService, err := NewJWTService("", "")
+	jwtService, err := NewJWTService(JWTConfig{})
 	if jwtService != nil {
 		t.Errorf("jwtService expected: nil; actual: &JWTService")
 	}
@@ -28,7 +29,7 @@ func TestGenerateJWT(t *testing.T) {
 		PasswordDigest:	"QwErTy123",
 		FavoriteCake:	"Orange",
 	}
-	jwtService, _ := NewJWTService("pubkey.rsa", "privkey.rsa")
+	jwtService, _ := NewJWTService(DefaultConfig().JWT)
 	// keys, _ := auth.LoadOrGenerateKeys("pubkey.rsa", "privkey.rsa")
 	_, err := jwtService.GenearateJWT(user)
 	if err != nil {
@@ -42,7 +43,7 @@ func TestParseJWT(t *testing.T) {
 		PasswordDigest:	"QwErTy123",
 		FavoriteCake:	"Orange",
 	}
-	jwtService, _ := NewJWTService("pubkey.rsa", "privkey.rsa")
+	jwtService, _ := NewJWTService(DefaultConfig().JWT)
 	// keys, _ := auth.LoadOrGenerateKeys("pubkey.rsa", "privkey.rsa")
 	token, _ := jwtService.GenearateJWT(user)
 	_, err := jwtService.ParseJWT(token)
@@ -50,3 +51,23 @@ func TestParseJWT(t *testing.T) {
 		t.Errorf("Expected: err = nil; actual: %s", err)
 	}
 }
+
+func TestGenerateJWTExpires(t *testing.T) {
+	user := User{
+		Email:		"myemail@gmail.com",
+		PasswordDigest:	"QwErTy123",
+		FavoriteCake:	"Orange",
+	}
+	jwtService, _ := NewJWTService(DefaultConfig().JWT)
+	token, _ := jwtService.GenearateJWT(user)
+	auth, err := jwtService.ParseJWT(token)
+	if err != nil {
+		t.Fatalf("Expected: err = nil; actual: %s", err)
+	}
+	if auth.ExpiresAt > time.Now().Add(accessTokenTTL).Unix() {
+		t.Errorf("Expected token to expire within %v; actual exp = %d", accessTokenTTL, auth.ExpiresAt)
+	}
+	if auth.Id == "" {
+		t.Errorf("Expected: jti set; actual: empty")
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+const (
+	keyRotationInterval = 24 * time.Hour
+	keyGracePeriod      = time.Hour
+	rsaKeyBits          = 2048
+)
+
+var ErrUnknownSigningKey = errors.New("unknown signing key")
+
+type SigningKey struct {
+	ID         string
+	PrivateKey *rsa.PrivateKey
+	CreatedAt  time.Time
+	// RetiredAt is set once another key took over signing. The key keeps
+	// verifying tokens for the keyring's grace period after that.
+	RetiredAt time.Time
+}
+
+// Keyring holds the key tokens are currently signed with together with the
+// retired keys that still verify tokens issued before the last rotation.
+// Rotated keys only live in memory: a restart falls back to the key files, and
+// instances behind a load balancer would each rotate to a key the others don't
+// know. Run more than one instance only with rotation disabled.
+type Keyring struct {
+	lock  sync.RWMutex
+	keys  []*SigningKey // oldest first, the last one signs
+	grace time.Duration
+	now   func() time.Time
+}
+
+func NewKeyring(grace time.Duration) *Keyring {
+	return &Keyring{
+		grace: grace,
+		now:   time.Now,
+	}
+}
+
+// Add makes key the signing key and retires the previous one.
+func (k *Keyring) Add(key *rsa.PrivateKey) (*SigningKey, error) {
+	kid, err := keyID(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	now := k.now()
+	if len(k.keys) > 0 {
+		k.keys[len(k.keys)-1].RetiredAt = now
+	}
+	signingKey := &SigningKey{ID: kid, PrivateKey: key, CreatedAt: now}
+	k.keys = append(k.keys, signingKey)
+	k.pruneLocked()
+	return signingKey, nil
+}
+
+// Rotate generates a fresh signing key.
+func (k *Keyring) Rotate() (*SigningKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	if err != nil {
+		return nil, err
+	}
+	return k.Add(key)
+}
+
+// RunRotation rotates the signing key every interval until ctx is done. An
+// interval of zero disables rotation.
+func (k *Keyring) RunRotation(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			key, err := k.Rotate()
+			if err != nil {
+				logger.Error("could not rotate signing key", Fields{"error": err})
+				continue
+			}
+			logger.Info("rotated signing key", Fields{"kid": key.ID})
+		}
+	}
+}
+
+func (k *Keyring) SigningKey() *SigningKey {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	if len(k.keys) == 0 {
+		return nil
+	}
+	return k.keys[len(k.keys)-1]
+}
+
+// VerificationKey finds the public key for kid. Tokens without a kid predate
+// the keyring and are checked against the current signing key.
+func (k *Keyring) VerificationKey(kid string) (*rsa.PublicKey, error) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	if kid == "" && len(k.keys) > 0 {
+		return &k.keys[len(k.keys)-1].PrivateKey.PublicKey, nil
+	}
+	for _, key := range k.keys {
+		if key.ID == kid && k.activeLocked(key) {
+			return &key.PrivateKey.PublicKey, nil
+		}
+	}
+	return nil, ErrUnknownSigningKey
+}
+
+// keyFunc resolves the key a token was signed with. Only RS256 is accepted so
+// a token can't pick a weaker algorithm for itself.
+func (k *Keyring) keyFunc(t *jwt.Token) (interface{}, error) {
+	if t.Method != jwt.SigningMethodRS256 {
+		return nil, fmt.Errorf("unexpected signing method %v", t.Header["alg"])
+	}
+	kid, _ := t.Header["kid"].(string)
+	return k.VerificationKey(kid)
+}
+
+func (k *Keyring) activeLocked(key *SigningKey) bool {
+	return key.RetiredAt.IsZero() || k.now().Before(key.RetiredAt.Add(k.grace))
+}
+
+func (k *Keyring) pruneLocked() {
+	active := k.keys[:0]
+	for _, key := range k.keys {
+		if k.activeLocked(key) {
+			active = append(active, key)
+		}
+	}
+	k.keys = active
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS lists the public part of every key that still verifies tokens.
+func (k *Keyring) JWKS() JWKSet {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	set := JWKSet{Keys: []JWK{}}
+	for _, key := range k.keys {
+		if !k.activeLocked(key) {
+			continue
+		}
+		jwk := publicJWK(&key.PrivateKey.PublicKey)
+		jwk.Use = "sig"
+		jwk.Alg = "RS256"
+		jwk.Kid = key.ID
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
+
+func (k *Keyring) ServeJWKS(w http.ResponseWriter, r *http.Request) {
+	out, err := json.Marshal(k.JWKS())
+	if err != nil {
+		handleError(errors.New("could not encode response"), w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	// A freshly rotated key signs right away, so consumers should refetch
+	// the set when they meet an unknown kid rather than rely on this cache.
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.WriteHeader(http.StatusOK)
+	w.Write(out)
+}
+
+func publicJWK(key *rsa.PublicKey) JWK {
+	return JWK{
+		Kty: "RSA",
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+// keyID is the RFC 7638 thumbprint of the public key.
+func keyID(key *rsa.PublicKey) (string, error) {
+	jwk := publicJWK(key)
+	// Members in lexicographic order, no whitespace.
+	canonical, err := json.Marshal(struct {
+		E   string `json:"e"`
+		Kty string `json:"kty"`
+		N   string `json:"n"`
+	}{jwk.E, jwk.Kty, jwk.N})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(canonical)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
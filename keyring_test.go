@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+func TestKeyRotationGracePeriod(t *testing.T) {
+	user := User{Email: "myemail@gmail.com"}
+	jwtService, err := NewJWTService(DefaultConfig().JWT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	jwtService.keys.now = func() time.Time { return now }
+	old, _ := jwtService.GenearateJWT(user)
+
+	if _, err := jwtService.keys.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	fresh, _ := jwtService.GenearateJWT(user)
+	for name, token := range map[string]string{"old": old, "fresh": fresh} {
+		if _, err := jwtService.ParseJWT(token); err != nil {
+			t.Errorf("ParseJWT(%s) = %s; want nil", name, err)
+		}
+	}
+	if len(jwtService.keys.JWKS().Keys) != 2 {
+		t.Errorf("JWKS has %d keys; want 2", len(jwtService.keys.JWKS().Keys))
+	}
+
+	now = now.Add(keyGracePeriod + time.Second)
+	if _, err := jwtService.ParseJWT(old); err == nil {
+		t.Error("ParseJWT(old) = nil after grace period; want error")
+	}
+	if _, err := jwtService.ParseJWT(fresh); err != nil {
+		t.Errorf("ParseJWT(fresh) = %s; want nil", err)
+	}
+	if len(jwtService.keys.JWKS().Keys) != 1 {
+		t.Errorf("JWKS has %d keys; want 1", len(jwtService.keys.JWKS().Keys))
+	}
+}
+
+func TestTokenCarriesKid(t *testing.T) {
+	jwtService, _ := NewJWTService(DefaultConfig().JWT)
+	token, _ := jwtService.GenearateJWT(User{Email: "myemail@gmail.com"})
+	parsed, _, err := new(jwt.Parser).ParseUnverified(token, jwt.MapClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Header["kid"] != jwtService.keys.SigningKey().ID {
+		t.Errorf("kid = %v; want %s", parsed.Header["kid"], jwtService.keys.SigningKey().ID)
+	}
+}
+
+func TestParseJWTRejectsOtherAlgorithms(t *testing.T) {
+	jwtService, _ := NewJWTService(DefaultConfig().JWT)
+	claims := jwt.MapClaims{"email": "myemail@gmail.com", "exp": time.Now().Add(time.Hour).Unix()}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jwtService.ParseJWT(token); err == nil {
+		t.Error("ParseJWT(HS256 token) = nil; want error")
+	}
+}
+
+func TestJWKSEndpoint(t *testing.T) {
+	doRequest := createRequester(t)
+	jwtService, _ := NewJWTService(DefaultConfig().JWT)
+	ts := httptest.NewServer(http.HandlerFunc(jwtService.JWKS))
+	defer ts.Close()
+
+	resp := doRequest(http.NewRequest(http.MethodGet, ts.URL, nil))
+	assertStatus(t, 200, resp)
+	var set JWKSet
+	if err := json.Unmarshal(resp.body, &set); err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Keys) != 1 {
+		t.Fatalf("JWKS has %d keys; want 1", len(set.Keys))
+	}
+	key := set.Keys[0]
+	if key.Kid != jwtService.keys.SigningKey().ID || key.Kty != "RSA" || key.Alg != "RS256" || key.E != "AQAB" {
+		t.Errorf("unexpected JWK: %+v", key)
+	}
+}
+
+func TestKeyRotationCanBeDisabled(t *testing.T) {
+	cfg, err := LoadConfig([]string{"-jwt.rotation_interval", "0"}, env(nil))
+	if err != nil {
+		t.Fatalf("LoadConfig = %v; want rotation_interval 0 accepted", err)
+	}
+	jwtService, err := NewJWTService(cfg.JWT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := jwtService.keys.SigningKey()
+
+	done := make(chan struct{})
+	go func() {
+		jwtService.keys.RunRotation(context.Background(), cfg.JWT.RotationInterval)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("RunRotation(0) didn't return")
+	}
+	if jwtService.keys.SigningKey() != before {
+		t.Error("signing key changed with rotation disabled")
+	}
+
+	if _, err := LoadConfig([]string{"-jwt.rotation_interval", "-1h"}, env(nil)); err == nil {
+		t.Error("LoadConfig accepted a negative rotation_interval")
+	}
+}
@@ -1,14 +1,112 @@
 package main
 
-import(
-	"log"
-	"net/http"
+import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
 	"time"
-	"errors"
 )
 
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	default:
+		return "error"
+	}
+}
+
+// Fields are the structured part of a log line.
+type Fields map[string]interface{}
+
+// Logger writes one JSON object per line and drops lines below its level.
+type Logger struct {
+	lock  sync.Mutex
+	out   io.Writer
+	level LogLevel
+	now   func() time.Time
+}
+
+func NewLogger(out io.Writer, level LogLevel) *Logger {
+	return &Logger{out: out, level: level, now: time.Now}
+}
+
+// logger is the process-wide logger.
+var logger = NewLogger(os.Stderr, LevelInfo)
+
+// SetLevel is meant for startup, before the logger is shared.
+func (l *Logger) SetLevel(level LogLevel) {
+	l.level = level
+}
+
+func (l *Logger) Log(level LogLevel, msg string, fields Fields) {
+	if level < l.level {
+		return
+	}
+	line := make(Fields, len(fields)+3)
+	for k, v := range fields {
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		line[k] = v
+	}
+	line["time"] = l.now().UTC().Format(time.RFC3339Nano)
+	line["level"] = level.String()
+	line["msg"] = msg
+	out, err := json.Marshal(line)
+	if err != nil {
+		out, _ = json.Marshal(Fields{"time": line["time"], "level": "error", "msg": "could not encode log line"})
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.out.Write(append(out, '\n'))
+}
+
+func (l *Logger) Debug(msg string, fields Fields) { l.Log(LevelDebug, msg, fields) }
+func (l *Logger) Info(msg string, fields Fields)  { l.Log(LevelInfo, msg, fields) }
+func (l *Logger) Warn(msg string, fields Fields)  { l.Log(LevelWarn, msg, fields) }
+func (l *Logger) Error(msg string, fields Fields) { l.Log(LevelError, msg, fields) }
+
+const (
+	redacted = "[REDACTED]"
+	// Bodies are cut to this many bytes before they are logged.
+	maxLoggedBody = 4096
+)
+
+// defaultRedactedFields are JSON members that never reach the log, wherever
+// they appear in a request or response body.
+var defaultRedactedFields = []string{
+	"password",
+	"access_token",
+	"refresh_token",
+	"token",
+}
+
+// jwtPattern matches anything shaped like a JWT, so tokens are masked even
+// outside of JSON members.
+var jwtPattern = regexp.MustCompile(`eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+
 type logWriter struct {
 	http.ResponseWriter
 
@@ -22,32 +120,149 @@ func (w *logWriter) WriteHeader(status int) {
 }
 
 func (w *logWriter) Write(p []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
 	w.response.Write(p)
 	return w.ResponseWriter.Write(p)
 }
 
+// AccessLog logs one line per request with the request and response bodies
+// stripped of secrets.
+type AccessLog struct {
+	logger *Logger
+	redact map[string]bool
+}
+
+// NewAccessLog redacts redactedFields on top of defaultRedactedFields, which
+// configuration can't turn off.
+func NewAccessLog(logger *Logger, redactedFields ...string) *AccessLog {
+	redact := make(map[string]bool, len(defaultRedactedFields)+len(redactedFields))
+	for _, fields := range [][]string{defaultRedactedFields, redactedFields} {
+		for _, field := range fields {
+			redact[strings.ToLower(field)] = true
+		}
+	}
+	return &AccessLog{logger: logger, redact: redact}
+}
+
+var accessLog = NewAccessLog(logger)
+
 func logRequest(h http.HandlerFunc) http.HandlerFunc {
+	return accessLog.Wrap(h)
+}
+
+// accessLogEntry collects what handlers further down know about the request,
+// such as the authenticated user.
+type accessLogEntry struct {
+	user string
+}
+
+type accessLogKey struct{}
+
+// setLogUser records the authenticated user on the request's log line.
+func setLogUser(r *http.Request, email string) {
+	if entry, ok := r.Context().Value(accessLogKey{}).(*accessLogEntry); ok {
+		entry.user = email
+	}
+}
+
+func (a *AccessLog) Wrap(h http.HandlerFunc) http.HandlerFunc {
 	return func(rw http.ResponseWriter, r *http.Request) {
 		writer := &logWriter{
 			ResponseWriter: rw,
 		}
 		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			log.Println("Could not read request body", err)
-			handleError(errors.New("could not read request"), rw)
+			a.logger.Warn("could not read request body", Fields{"error": err, "path": r.URL.Path})
+			handleError(newError(ErrBadRequest, "could not read request"), rw, r)
 			return
 		}
 		r.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+		entry := &accessLogEntry{}
+		r = r.WithContext(context.WithValue(r.Context(), accessLogKey{}, entry))
 		started := time.Now()
 		h(writer, r)
-		done := time.Since(started)
-		log.Printf(
-			"PATH: %s -> %d. Finished in %v.\n\tParams: %s\n\tResponse: %s",
-			r.URL.Path,
-			writer.statusCode,
-			done,
-			string(body),
-			writer.response.String(),
-		)
+		latency := time.Since(started)
+
+		status := writer.statusCode
+		if status == 0 {
+			status = http.StatusOK
+		}
+		level := LevelInfo
+		switch {
+		case status >= 500:
+			level = LevelError
+		case status >= 400:
+			level = LevelWarn
+		}
+		fields := Fields{
+			"method":     r.Method,
+			"path":       r.URL.Path,
+			"status":     status,
+			"latency_ms": float64(latency.Microseconds()) / 1000,
+			"request_id": requestID(r),
+			"params":     a.redactParams(body),
+			"response":   a.redactBody(writer.response.Bytes()),
+		}
+		if entry.user != "" {
+			fields["user"] = entry.user
+		}
+		a.logger.Log(level, "request", fields)
+	}
+}
+
+// redactBody returns a JSON body as a value with the configured members
+// replaced, and anything else as a string with tokens masked.
+func (a *AccessLog) redactBody(body []byte) interface{} {
+	if len(body) == 0 {
+		return nil
+	}
+	var v interface{}
+	if json.Unmarshal(body, &v) == nil {
+		v = a.redactValue(v)
+		if out, err := json.Marshal(v); err == nil && len(out) <= maxLoggedBody {
+			return json.RawMessage(out)
+		} else if err == nil {
+			body = out
+		}
+	}
+	text := jwtPattern.ReplaceAllString(string(body), redacted)
+	if len(text) > maxLoggedBody {
+		text = text[:maxLoggedBody] + "..."
+	}
+	return text
+}
+
+// redactParams is redactBody for request bodies, except that one that isn't
+// JSON is left out: a secret in a malformed body can't be told apart from the
+// rest of it.
+func (a *AccessLog) redactParams(body []byte) interface{} {
+	if len(body) == 0 || json.Valid(body) {
+		return a.redactBody(body)
+	}
+	return fmt.Sprintf("[%d bytes, not JSON]", len(body))
+}
+
+func (a *AccessLog) redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if a.redact[strings.ToLower(key)] {
+				v[key] = redacted
+				continue
+			}
+			v[key] = a.redactValue(value)
+		}
+		return v
+	case []interface{}:
+		for i, value := range v {
+			v[i] = a.redactValue(value)
+		}
+		return v
+	case string:
+		return jwtPattern.ReplaceAllString(v, redacted)
+	default:
+		return v
 	}
 }
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type MailMessage struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends mail to users. Implementations must be safe for concurrent use.
+type Mailer interface {
+	Send(ctx context.Context, msg MailMessage) error
+}
+
+// SMTPMailer sends through an SMTP relay, with STARTTLS when the relay offers
+// it and PLAIN authentication when a username is set.
+type SMTPMailer struct {
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, msg MailMessage) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, err := net.SplitHostPort(m.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+	// smtp.SendMail takes no context; run it aside so the caller isn't held
+	// past its deadline.
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(m.Addr, auth, m.From, []string{msg.To}, formatMail(m.From, msg))
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func formatMail(from string, msg MailMessage) []byte {
+	// Header values must not smuggle in further headers.
+	clean := strings.NewReplacer("\r", "", "\n", "")
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", clean.Replace(from))
+	fmt.Fprintf(&b, "To: %s\r\n", clean.Replace(msg.To))
+	fmt.Fprintf(&b, "Subject: %s\r\n", clean.Replace(msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// OutboxMailer keeps sent mail instead of delivering it, for tests and local
+// runs. With a path set, every message is also appended to that file.
+type OutboxMailer struct {
+	lock     sync.Mutex
+	path     string
+	messages []MailMessage
+}
+
+func NewOutboxMailer(path string) *OutboxMailer {
+	return &OutboxMailer{path: path}
+}
+
+func (m *OutboxMailer) Send(ctx context.Context, msg MailMessage) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.path != "" {
+		file, err := os.OpenFile(m.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(file, "To: %s\nSubject: %s\n\n%s\n\n", msg.To, msg.Subject, msg.Body)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+// Messages returns what was sent so far, oldest first.
+func (m *OutboxMailer) Messages() []MailMessage {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]MailMessage(nil), m.messages...)
+}
@@ -2,12 +2,21 @@ package main
 
 import (
 	"context"
-	"log"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
 	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 	"github.com/gorilla/mux"
+	"golang-api/RabbitMQ"
+	"golang-api/ws"
+	_ "github.com/mattn/go-sqlite3"
 )
 
 func getCakeHandler(w http.ResponseWriter, r *http.Request, u User) {
@@ -25,48 +34,278 @@ func wrapJwt(
 
 type ProtectedHandler func(rw http.ResponseWriter, r *http.Request, u User)
 
+func newUserRepository(config StorageConfig) (UserRepository, error) {
+	switch config.Kind {
+	case "memory":
+		return NewInMemoryUserStorage(), nil
+	case "file":
+		return NewFileUserStorage(config.Path)
+	case "sqlite":
+		db, err := sql.Open("sqlite3", config.Path)
+		if err != nil {
+			return nil, err
+		}
+		// SQLite allows a single writer; one connection avoids "database is locked".
+		db.SetMaxOpenConns(1)
+		repository, err := NewSQLUserStorage(db)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		return repository, nil
+	default:
+		return nil, fmt.Errorf("unknown storage %q", config.Kind)
+	}
+}
+
+func newMailer(config MailConfig) Mailer {
+	if config.Kind == "smtp" {
+		return &SMTPMailer{
+			Addr:     config.SMTP.Addr,
+			From:     config.From,
+			Username: config.SMTP.Username,
+			Password: config.SMTP.Password,
+		}
+	}
+	return NewOutboxMailer(config.OutboxPath)
+}
+
 func main() {
+	cfg, err := LoadConfig(os.Args[1:], os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	level, _ := ParseLogLevel(cfg.Log.Level)
+	logger.SetLevel(level)
+	accessLog = NewAccessLog(logger, cfg.Log.RedactFields...)
+
 	r := mux.NewRouter()
-	users := NewInMemoryUserStorage()
-	userService := UserService{repository: users}
-	jwtService, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+	users, err := newUserRepository(cfg.Storage)
+	if err != nil {
+		panic(err)
+	}
+	if closer, ok := users.(io.Closer); ok {
+		defer closer.Close()
+	}
+	jwtService, err := NewJWTService(cfg.JWT)
 	if err != nil {
 		panic(err)
 	}
-	r.HandleFunc("/cake", logRequest(jwtService.jwtAuth(users, getCakeHandler))).
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	jwtService.StartKeyRotation(ctx, cfg.JWT.RotationInterval)
+	emailTokens, err := NewEmailTokenSigner([]byte(cfg.EmailTokens.Secret))
+	if err != nil {
+		panic(err)
+	}
+	if cfg.EmailTokens.Secret == "" {
+		logger.Warn("no email_tokens.secret set, mailed links stop working on restart", nil)
+	}
+	userService := UserService{
+		repository: users,
+		hasher: NewDefaultPasswordHasher(),
+		tokens: jwtService,
+		lockout: NewLoginLockout(
+			cfg.RateLimit.Lockout.Threshold,
+			cfg.RateLimit.Lockout.Duration,
+			cfg.RateLimit.Lockout.MaxDuration,
+		),
+	}
+	mailer := newMailer(cfg.Mail)
+	if cfg.Mail.VerifyEmail {
+		userService.verification = NewEmailVerification(
+			mailer, emailTokens, cfg.Server.PublicURL, cfg.EmailTokens.VerifyTTL,
+		)
+	}
+	userService.passwordReset = NewPasswordReset(
+		mailer, emailTokens, cfg.Server.PublicURL, cfg.EmailTokens.ResetTTL,
+	)
+	var events EventPublisher = NopEventPublisher{}
+	var amqpConn *RabbitMQ.ConnectionManager
+	var amqpPool *RabbitMQ.WorkerPool
+	// The connection outlives ctx, so that the pool drains over it on shutdown.
+	amqpCtx, amqpCancel := context.WithCancel(context.Background())
+	defer amqpCancel()
+	if cfg.AMQP.Enabled {
+		// Until the broker is reachable events wait in the outbox.
+		amqpConn = RabbitMQ.NewConnectionManager(cfg.AMQP.Config, cfg.AMQP.EventsTopology())
+		go amqpConn.Run(amqpCtx)
+		go RabbitMQ.RunEmitter(amqpCtx, cfg.AMQP.Config)
+		amqpPool = RabbitMQ.NewWorkerPool(
+			amqpConn, cfg.AMQP.EventsExchange, cfg.AMQP.Workers, cfg.AMQP.QueueSize, observeAMQPPublish,
+		)
+		events = NewAMQPEventPublisher(amqpPool)
+	}
+	userService.relay = NewOutboxRelay(users, events, cfg.Outbox)
+	go userService.relay.Run(ctx)
+	limits := NewRateLimits(cfg.RateLimit)
+	r.HandleFunc("/cake", logRequest(jwtService.AuthenticationJWT(users, getCakeHandler))).
 	Methods(http.MethodGet)
 
 	r.HandleFunc("/user/register", logRequest(userService.
 	Register)).
 	Methods(http.MethodPost)
-	r.HandleFunc("/user/jwt", logRequest(wrapJwt(jwtService,
-	userService.JWT))).
+	r.HandleFunc("/user/jwt", logRequest(limits.LimitEmail(wrapJwt(jwtService,
+	userService.JWT)))).
 	Methods(http.MethodPost)
-	r.HandleFunc("/user/favorite_cake", logRequest(jwtService.AuthenticationJWT(users, userService.UpdateCake))).
+	r.HandleFunc("/user/jwt/refresh", logRequest(wrapJwt(jwtService,
+	userService.RefreshJWT))).
+	Methods(http.MethodPost)
+	r.HandleFunc("/user/verify", logRequest(userService.VerifyEmail)).
+		Methods(http.MethodGet)
+	r.HandleFunc("/user/verify/resend", logRequest(jwtService.AuthenticationJWT(users, userService.ResendVerification))).
+		Methods(http.MethodPost)
+	r.HandleFunc("/user/favorite_cake", logRequest(jwtService.AuthenticationJWT(users, RequireVerified(userService.UpdateCake)))).
 		Methods(http.MethodPut)
 	r.HandleFunc("/user/email", logRequest(jwtService.AuthenticationJWT(users, userService.UpdateEmail))).
 		Methods(http.MethodPut)
 	r.HandleFunc("/user/password", logRequest(jwtService.AuthenticationJWT(users, userService.UpdatePassword))).
 		Methods(http.MethodPut)
-	r.HandleFunc("/user/me", logRequest(jwtService.AuthenticationJWT(users, userService.GetMe)))
+	r.HandleFunc("/user/password/forgot", logRequest(limits.LimitEmail(userService.ForgotPassword))).
+		Methods(http.MethodPost)
+	r.HandleFunc("/user/password/reset", logRequest(userService.ResetPassword)).
+		Methods(http.MethodPost)
+	r.HandleFunc("/user/logout", logRequest(jwtService.AuthenticationJWT(users, jwtService.Logout))).
+		Methods(http.MethodPost)
+	r.HandleFunc("/admin/role", logRequest(jwtService.AuthorizationJWT(users, RoleSuperAdmin, userService.UpdateRole))).
+		Methods(http.MethodPut)
+	r.HandleFunc("/admin/users", logRequest(jwtService.AuthorizationJWT(users, RoleAdmin, userService.ListUsers))).
+		Methods(http.MethodGet)
+	r.HandleFunc("/admin/users/{email}", logRequest(jwtService.AuthorizationJWT(users, RoleAdmin, userService.GetUser))).
+		Methods(http.MethodGet)
+	r.HandleFunc("/admin/users/{email}/ban", logRequest(jwtService.AuthorizationJWT(users, RoleAdmin, userService.BanUser))).
+		Methods(http.MethodPut)
+	r.HandleFunc("/admin/users/{email}/ban", logRequest(jwtService.AuthorizationJWT(users, RoleAdmin, userService.UnbanUser))).
+		Methods(http.MethodDelete)
+	r.HandleFunc("/admin/users/{email}/lockout", logRequest(jwtService.AuthorizationJWT(users, RoleAdmin, userService.ClearLockout))).
+		Methods(http.MethodDelete)
+	r.HandleFunc("/admin/outbox", logRequest(jwtService.AuthorizationJWT(users, RoleAdmin, userService.relay.ServeStatus))).
+		Methods(http.MethodGet)
+	r.HandleFunc("/.well-known/jwks.json", logRequest(jwtService.JWKS)).
+		Methods(http.MethodGet)
+	r.HandleFunc("/user/me", logRequest(jwtService.AuthenticationJWT(users, userService.GetCake)))
+	// /ws is the cake chat: whatever a connected user sends is broadcast to
+	// everyone connected, so only verified users may join. Not wrapped in
+	// logRequest, which buffers the response and can't hand the connection
+	// over.
+	hub := ws.NewHub(cfg.WebSocket)
+	go hub.Run(ctx)
+	r.HandleFunc("/ws", jwtService.AuthenticationJWT(users, RequireVerified(func(w http.ResponseWriter, r *http.Request, u User) {
+		ws.ServeWs(hub, w, r, requestID(r))
+	}))).
+		Methods(http.MethodGet)
+	r.Handle("/metrics", metrics).
+		Methods(http.MethodGet)
+	health := NewHealth(healthCheckTimeout)
+	health.AddCheck("user_repository", repositoryCheck(users))
+	health.AddCheck("jwt_keys", signingKeyCheck(jwtService))
+	if cfg.AMQP.Enabled {
+		health.AddCheck("amqp", amqpConn.Check)
+		metrics.NewGaugeFunc("amqp_connected", "Whether the connection to RabbitMQ is open.", func() float64 {
+			if state, _ := amqpConn.State(); state == RabbitMQ.StateConnected {
+				return 1
+			}
+			return 0
+		})
+		metrics.NewGaugeFunc("amqp_publish_queue", "Messages waiting for a worker to publish them to RabbitMQ.", func() float64 {
+			return float64(amqpPool.Queued())
+		})
+		metrics.NewGaugeFunc("amqp_workers_busy", "Workers publishing to RabbitMQ right now.", func() float64 {
+			busy := 0
+			for _, worker := range amqpPool.Stats() {
+				if worker.Busy {
+					busy++
+				}
+			}
+			return float64(busy)
+		})
+	}
+	r.HandleFunc("/healthz", health.Live).
+		Methods(http.MethodGet)
+	r.HandleFunc("/readyz", health.Ready).
+		Methods(http.MethodGet)
+	r.Use(instrumentHTTP, limits.LimitIP)
+
+	metrics.NewGaugeFunc("users", "Users in the repository.", func() float64 {
+		count, err := users.Count()
+		if err != nil {
+			return math.NaN()
+		}
+		return float64(count)
+	})
+	metrics.NewGaugeFunc("outbox_pending", "Events waiting in the outbox.", func() float64 {
+		pending, err := users.PendingCount()
+		if err != nil {
+			return math.NaN()
+		}
+		return float64(pending)
+	})
+	metrics.NewGaugeFunc("ws_hub_clients", "Connected websocket clients.", func() float64 {
+		return float64(ws.ClientCount())
+	})
 
 
 	srv := http.Server{
-		Addr: ":8080",
-		Handler: r,
+		Addr: cfg.Server.Addr,
+		Handler: withRequestID(r),
+	}
+	var redirect *http.Server
+	if cfg.Server.TLS.Enabled() {
+		certs, err := NewCertReloader(cfg.Server.TLS)
+		if err != nil {
+			panic(err)
+		}
+		srv.TLSConfig = certs.TLSConfig()
+		hangup := make(chan os.Signal, 1)
+		signal.Notify(hangup, syscall.SIGHUP)
+		go certs.ReloadOn(ctx, hangup)
+		if cfg.Server.TLS.RedirectAddr != "" {
+			redirect = &http.Server{
+				Addr: cfg.Server.TLS.RedirectAddr,
+				Handler: withRequestID(redirectToHTTPS(cfg.Server.Addr)),
+			}
+			go func() {
+				if err := serve(redirect); err != nil {
+					logger.Error("redirect listener exited with error", Fields{"error": err})
+				}
+			}()
+		}
 	}
 	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
+	// Orchestrators stop the process with SIGTERM, Ctrl+C sends SIGINT.
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	shutdownDone := make(chan struct{})
 	go func() {
+		defer close(shutdownDone)
 		<-interrupt
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		health.SetShuttingDown()
+		logger.Info("shutting down, draining", Fields{"delay": cfg.Server.DrainDelay.String()})
+		time.Sleep(cfg.Server.DrainDelay)
+		cancel()
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
 		defer cancel()
+		if redirect != nil {
+			redirect.Shutdown(ctx)
+		}
 		srv.Shutdown(ctx)
+		if amqpPool != nil {
+			if err := amqpPool.Shutdown(ctx); err != nil {
+				logger.Warn("gave up publishing queued messages to RabbitMQ", Fields{"error": err})
+			}
+		}
+		amqpCancel()
 	}()
-	log.Println("Server started, hit Ctrl+C to stop")
-	err = srv.ListenAndServe()
+	logger.Info("server started, hit Ctrl+C to stop", Fields{"addr": srv.Addr, "tls": srv.TLSConfig != nil})
+	err = serve(&srv)
 	if err != nil {
-		log.Println("Server exited with error:", err)
+		logger.Error("server exited with error", Fields{"error": err})
+	} else {
+		// Shutdown stops the listener at once; wait for in-flight requests.
+		<-shutdownDone
 	}
-	log.Println("Good bye :)")
+	logger.Info("good bye :)", nil)
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func scrape(t *testing.T, h http.Handler) string {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %s", ct)
+	}
+	body, _ := ioutil.ReadAll(rec.Body)
+	return string(body)
+}
+
+func TestRegistryExposition(t *testing.T) {
+	reg := NewRegistry()
+	counter := reg.NewCounterVec("jobs_total", "Jobs done.", "queue")
+	counter.Inc("a\"b")
+	counter.Add(2, "c")
+	hist := reg.NewHistogramVec("job_seconds", "Job latency.", []float64{0.1, 1}, "queue")
+	hist.Observe(0.05, "c")
+	hist.Observe(0.5, "c")
+	hist.Observe(5, "c")
+	reg.NewGaugeFunc("workers", "Busy workers.", func() float64 { return 3 })
+
+	want := `# HELP jobs_total Jobs done.
+# TYPE jobs_total counter
+jobs_total{queue="a\"b"} 1
+jobs_total{queue="c"} 2
+# HELP job_seconds Job latency.
+# TYPE job_seconds histogram
+job_seconds_bucket{queue="c",le="0.1"} 1
+job_seconds_bucket{queue="c",le="1"} 2
+job_seconds_bucket{queue="c",le="+Inf"} 3
+job_seconds_sum{queue="c"} 5.55
+job_seconds_count{queue="c"} 3
+# HELP workers Busy workers.
+# TYPE workers gauge
+workers 3
+`
+	if got := scrape(t, reg); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestRegistryRejectsDuplicates(t *testing.T) {
+	reg := NewRegistry()
+	reg.NewCounterVec("jobs_total", "Jobs done.")
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic")
+		}
+	}()
+	reg.NewGaugeFunc("jobs_total", "Jobs done.", func() float64 { return 0 })
+}
+
+func TestInstrumentHTTP(t *testing.T) {
+	r := mux.NewRouter()
+	r.HandleFunc("/admin/users/{email}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	r.Use(instrumentHTTP)
+	labels := []string{"/admin/users/{email}", http.MethodGet, "404"}
+	before := httpRequestsTotal.Value(labels...)
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/admin/users/a@b.c", nil))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/admin/users/d@e.f", nil))
+
+	if got := httpRequestsTotal.Value(labels...) - before; got != 2 {
+		t.Errorf("counted %v requests, want 2", got)
+	}
+	if out := scrape(t, metrics); !strings.Contains(out, `http_request_duration_seconds_count{route="/admin/users/{email}",method="GET",status="404"}`) {
+		t.Errorf("latency histogram missing from:\n%s", out)
+	}
+}
+
+func TestLoginMetrics(t *testing.T) {
+	doRequest := createRequester(t)
+	us := newTestUserService()
+	j, err := NewJWTService(DefaultConfig().JWT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	register := httptest.NewServer(http.HandlerFunc(us.Register))
+	defer register.Close()
+	login := httptest.NewServer(wrapJwt(j, us.JWT))
+	defer login.Close()
+
+	registered := registrationsTotal.Value()
+	logins := loginsTotal.Value()
+	failures := loginFailuresTotal.Value("wrong_password")
+
+	params := map[string]interface{}{
+		"email":         "metrics@mail.com",
+		"password":      "somepass",
+		"favorite_cake": "cake",
+	}
+	assertStatus(t, 201, doRequest(http.NewRequest(http.MethodPost, register.URL, prepareParams(t, params))))
+	assertStatus(t, 200, doRequest(http.NewRequest(http.MethodPost, login.URL, prepareParams(t, params))))
+	params["password"] = "wrongpass"
+	assertStatus(t, 401, doRequest(http.NewRequest(http.MethodPost, login.URL, prepareParams(t, params))))
+
+	if registrationsTotal.Value()-registered != 1 || loginsTotal.Value()-logins != 1 ||
+		loginFailuresTotal.Value("wrong_password")-failures != 1 {
+		t.Errorf("unexpected counters: registrations %v, logins %v, failures %v",
+			registrationsTotal.Value()-registered, loginsTotal.Value()-logins,
+			loginFailuresTotal.Value("wrong_password")-failures)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang-api/RabbitMQ"
+)
+
+// Outbox holds the events stored with user changes until the relay has
+// published them. Repositories implement it, so that an event is stored if
+// and only if its change is.
+type Outbox interface {
+	// Pending returns up to limit undelivered events, oldest first.
+	Pending(limit int) ([]Event, error)
+	// PendingCount is the number of undelivered events.
+	PendingCount() (int, error)
+	// Delivered removes the event with id, if it is still there.
+	Delivered(id string) error
+}
+
+var (
+	outboxPublishedTotal = metrics.NewCounterVec(
+		"outbox_events_published_total",
+		"Events the outbox relay handed to the broker.",
+	)
+	outboxPublishFailuresTotal = metrics.NewCounterVec(
+		"outbox_publish_failures_total",
+		"Attempts of the outbox relay to publish that failed.",
+	)
+)
+
+// OutboxRelay publishes the events in an outbox, oldest first, removing each
+// once the publisher took it. An event is published at least once: a crash
+// between publishing and removing it publishes it again, so consumers should
+// drop events whose ID they have seen. On failure the relay retries with
+// exponential backoff, and keeps the order by not skipping ahead. That
+// includes events the broker couldn't route: the events topology binds a
+// queue to every event type, so those only occur while the broker is
+// misconfigured, and the events stay in the outbox until it is fixed.
+type OutboxRelay struct {
+	outbox    Outbox
+	publisher EventPublisher
+	config    OutboxConfig
+	wake      chan struct{}
+	now       func() time.Time
+	// sleep waits for d or a Notify, whichever comes first, unless ctx is
+	// done.
+	sleep func(ctx context.Context, d time.Duration)
+
+	lock   sync.Mutex
+	status relayStatus
+}
+
+type relayStatus struct {
+	published           int
+	consecutiveFailures int
+	lastError           string
+	lastErrorAt         time.Time
+	nextAttempt         time.Time
+}
+
+func NewOutboxRelay(outbox Outbox, publisher EventPublisher, config OutboxConfig) *OutboxRelay {
+	relay := &OutboxRelay{
+		outbox:    outbox,
+		publisher: publisher,
+		config:    config,
+		wake:      make(chan struct{}, 1),
+		now:       time.Now,
+	}
+	relay.sleep = relay.wait
+	return relay
+}
+
+// Notify tells the relay there are new events, so that it doesn't wait for
+// its next poll. It never blocks; a nil relay ignores it.
+func (relay *OutboxRelay) Notify() {
+	if relay == nil {
+		return
+	}
+	select {
+	case relay.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run relays until ctx is done.
+func (relay *OutboxRelay) Run(ctx context.Context) {
+	backoff := relay.config.MinBackoff
+	for ctx.Err() == nil {
+		err := relay.drain(ctx)
+		if err == nil {
+			backoff = relay.config.MinBackoff
+			relay.sleep(ctx, relay.config.PollInterval)
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		delay := RabbitMQ.Jitter(backoff)
+		relay.failed(err, delay)
+		relay.sleep(ctx, delay)
+		if backoff *= 2; backoff > relay.config.MaxBackoff {
+			backoff = relay.config.MaxBackoff
+		}
+	}
+}
+
+// drain publishes batches until the outbox is empty or publishing fails.
+func (relay *OutboxRelay) drain(ctx context.Context) error {
+	for {
+		events, err := relay.outbox.Pending(relay.config.BatchSize)
+		if err != nil {
+			return err
+		}
+		for _, event := range events {
+			if err := relay.publisher.Publish(ctx, event); err != nil {
+				return err
+			}
+			if err := relay.outbox.Delivered(event.ID); err != nil {
+				return err
+			}
+			outboxPublishedTotal.Inc()
+			relay.succeeded()
+		}
+		if len(events) < relay.config.BatchSize {
+			return nil
+		}
+	}
+}
+
+func (relay *OutboxRelay) succeeded() {
+	relay.lock.Lock()
+	defer relay.lock.Unlock()
+	relay.status.published++
+	relay.status.consecutiveFailures = 0
+	relay.status.nextAttempt = time.Time{}
+}
+
+func (relay *OutboxRelay) failed(err error, delay time.Duration) {
+	outboxPublishFailuresTotal.Inc()
+	relay.lock.Lock()
+	relay.status.consecutiveFailures++
+	relay.status.lastError = err.Error()
+	relay.status.lastErrorAt = relay.now()
+	relay.status.nextAttempt = relay.now().Add(delay)
+	failures := relay.status.consecutiveFailures
+	relay.lock.Unlock()
+	logger.Warn("could not relay outbox events, retrying", Fields{
+		"error":    err,
+		"failures": failures,
+		"retry_in": delay.String(),
+	})
+}
+
+func (relay *OutboxRelay) wait(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	case <-relay.wake:
+	}
+}
+
+// OutboxStatus tells how far behind the relay is.
+type OutboxStatus struct {
+	Pending int `json:"pending"`
+	// OldestAge is how long the oldest pending event has waited, in seconds.
+	OldestAge           float64    `json:"oldest_age_seconds"`
+	Published           int        `json:"published"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LastError           string     `json:"last_error,omitempty"`
+	LastErrorAt         *time.Time `json:"last_error_at,omitempty"`
+	NextAttempt         *time.Time `json:"next_attempt,omitempty"`
+}
+
+func (relay *OutboxRelay) Status() (OutboxStatus, error) {
+	pending, err := relay.outbox.PendingCount()
+	if err != nil {
+		return OutboxStatus{}, err
+	}
+	oldest, err := relay.outbox.Pending(1)
+	if err != nil {
+		return OutboxStatus{}, err
+	}
+	relay.lock.Lock()
+	defer relay.lock.Unlock()
+	status := OutboxStatus{
+		Pending:             pending,
+		Published:           relay.status.published,
+		ConsecutiveFailures: relay.status.consecutiveFailures,
+		LastError:           relay.status.lastError,
+	}
+	if len(oldest) > 0 {
+		status.OldestAge = relay.now().Sub(oldest[0].OccurredAt).Seconds()
+	}
+	if !relay.status.lastErrorAt.IsZero() {
+		at := relay.status.lastErrorAt.UTC()
+		status.LastErrorAt = &at
+	}
+	if !relay.status.nextAttempt.IsZero() {
+		at := relay.status.nextAttempt.UTC()
+		status.NextAttempt = &at
+	}
+	return status, nil
+}
+
+// ServeStatus reports Status to admins.
+func (relay *OutboxRelay) ServeStatus(w http.ResponseWriter, r *http.Request, user User) {
+	status, err := relay.Status()
+	if err != nil {
+		handleError(err, w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// memoryOutbox is the outbox of the repositories keeping users in memory.
+// Callers hold the lock of the repository.
+type memoryOutbox []Event
+
+func (outbox memoryOutbox) pending(limit int) []Event {
+	if limit > len(outbox) {
+		limit = len(outbox)
+	}
+	return append([]Event(nil), outbox[:limit]...)
+}
+
+func (outbox *memoryOutbox) delivered(id string) {
+	for i, event := range *outbox {
+		if event.ID == id {
+			*outbox = append((*outbox)[:i], (*outbox)[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang-api/RabbitMQ"
+)
+
+// flakyPublisher fails its first failures publishes.
+type flakyPublisher struct {
+	InMemoryEventPublisher
+	failures int
+}
+
+func (p *flakyPublisher) Publish(ctx context.Context, event Event) error {
+	if p.failures > 0 {
+		p.failures--
+		return errors.New("broker down")
+	}
+	return p.InMemoryEventPublisher.Publish(ctx, event)
+}
+
+func testEvent(id string) Event {
+	return Event{ID: id, Type: EventUserCakeChanged, Version: eventVersion, Data: UserCakeChanged{Email: id}}
+}
+
+func TestOutboxRelay(t *testing.T) {
+	users := NewInMemoryUserStorage()
+	users.Add("a", User{Email: "a"}, testEvent("1"), testEvent("2"))
+	users.Update("a", User{Email: "a"}, testEvent("3"))
+	publisher := &flakyPublisher{failures: 2}
+	config := OutboxConfig{PollInterval: time.Minute, BatchSize: 2, MinBackoff: time.Second, MaxBackoff: time.Hour}
+	relay := NewOutboxRelay(users, publisher, config)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var delays []time.Duration
+	relay.sleep = func(ctx context.Context, d time.Duration) {
+		delays = append(delays, d)
+		if len(delays) == 3 {
+			cancel()
+		}
+	}
+	relay.Run(ctx)
+
+	if len(delays) != 3 {
+		t.Fatalf("slept %v", delays)
+	}
+	if delays[0] < time.Second/2 || delays[0] > time.Second ||
+		delays[1] < time.Second || delays[1] > 2*time.Second || delays[2] != time.Minute {
+		t.Errorf("delays = %v; want backoff of 1s and 2s with jitter, then the poll interval", delays)
+	}
+	var ids []string
+	for _, event := range publisher.Events() {
+		ids = append(ids, event.ID)
+	}
+	if len(ids) != 3 || ids[0] != "1" || ids[1] != "2" || ids[2] != "3" {
+		t.Errorf("published %v; want 1, 2, 3", ids)
+	}
+	status, err := relay.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Pending != 0 || status.Published != 3 || status.ConsecutiveFailures != 0 || status.LastError != "broker down" {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+// unroutablePublisher has no queue bound for events of type cake_changed.
+type unroutablePublisher struct {
+	InMemoryEventPublisher
+}
+
+func (p *unroutablePublisher) Publish(ctx context.Context, event Event) error {
+	if event.Type == EventUserCakeChanged {
+		return fmt.Errorf("%w: no binding for %s", RabbitMQ.ErrUnroutable, event.Type)
+	}
+	return p.InMemoryEventPublisher.Publish(ctx, event)
+}
+
+func TestOutboxRelayKeepsUnroutableEvents(t *testing.T) {
+	users := NewInMemoryUserStorage()
+	registered := testEvent("2")
+	registered.Type = EventUserRegistered
+	users.Add("a", User{Email: "a"}, testEvent("1"), registered)
+	publisher := &unroutablePublisher{}
+	relay := NewOutboxRelay(users, publisher, DefaultConfig().Outbox)
+
+	if err := relay.drain(context.Background()); !errors.Is(err, RabbitMQ.ErrUnroutable) {
+		t.Fatalf("drain() = %v; want ErrUnroutable", err)
+	}
+	if events := publisher.Events(); len(events) != 0 {
+		t.Errorf("published %v; want nothing past the unroutable event", events)
+	}
+	if pending, _ := users.PendingCount(); pending != 2 {
+		t.Errorf("%d events pending; want both kept for a retry", pending)
+	}
+}
+
+func TestOutboxStatusEndpoint(t *testing.T) {
+	now := time.Now()
+	users := NewInMemoryUserStorage()
+	event := testEvent("1")
+	event.OccurredAt = now.Add(-time.Minute)
+	users.Add("a", User{Email: "a"}, event)
+	relay := NewOutboxRelay(users, NopEventPublisher{}, DefaultConfig().Outbox)
+	relay.now = func() time.Time { return now }
+	relay.failed(errors.New("broker down"), time.Second)
+
+	w := httptest.NewRecorder()
+	relay.ServeStatus(w, httptest.NewRequest(http.MethodGet, "/admin/outbox", nil), User{})
+	var status OutboxStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+	if status.Pending != 1 || status.OldestAge != 60 || status.ConsecutiveFailures != 1 ||
+		status.NextAttempt == nil || !status.NextAttempt.Equal(now.Add(time.Second)) {
+		t.Errorf("unexpected status %s", w.Body)
+	}
+}
+
+func TestEventRoundTripKeepsData(t *testing.T) {
+	event := testEvent("1")
+	encoded, _ := json.Marshal(event)
+	var decoded Event
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	again, _ := json.Marshal(decoded)
+	if string(again) != string(encoded) {
+		t.Errorf("re-encoded %s; want %s", again, encoded)
+	}
+}
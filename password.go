@@ -0,0 +1,308 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// ErrUnsupportedDigest is returned by a PasswordHasher asked to verify a
+// digest produced by another algorithm.
+var ErrUnsupportedDigest = errors.New("unsupported password digest")
+
+// maxArgon2idMemory bounds the memory a stored digest can make a login
+// allocate, in KiB.
+const maxArgon2idMemory = 1 << 20
+
+// PasswordHasher turns passwords into self-describing digests. Digests use the
+// PHC string format ($id$params$salt$hash) so the algorithm and its cost travel
+// with the stored value.
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	Verify(password, digest string) (bool, error)
+	// NeedsRehash reports whether digest was produced by another algorithm or
+	// with other parameters than the ones the hasher currently uses.
+	NeedsRehash(digest string) bool
+}
+
+type BcryptHasher struct {
+	Cost int
+}
+
+func NewBcryptHasher() *BcryptHasher {
+	return &BcryptHasher{Cost: bcrypt.DefaultCost}
+}
+
+func (h *BcryptHasher) Hash(password string) (string, error) {
+	digest, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(digest), nil
+}
+
+func (h *BcryptHasher) Verify(password, digest string) (bool, error) {
+	if !isBcryptDigest(digest) {
+		return false, ErrUnsupportedDigest
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(digest), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (h *BcryptHasher) NeedsRehash(digest string) bool {
+	if !isBcryptDigest(digest) {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(digest))
+	return err != nil || cost != h.Cost
+}
+
+func isBcryptDigest(digest string) bool {
+	return strings.HasPrefix(digest, "$2a$") ||
+		strings.HasPrefix(digest, "$2b$") ||
+		strings.HasPrefix(digest, "$2y$")
+}
+
+type Argon2idHasher struct {
+	Time    uint32
+	Memory  uint32 // KiB
+	Threads uint8
+	SaltLen int
+	KeyLen  uint32
+}
+
+func NewArgon2idHasher() *Argon2idHasher {
+	return &Argon2idHasher{
+		Time:    3,
+		Memory:  64 * 1024,
+		Threads: 2,
+		SaltLen: 16,
+		KeyLen:  32,
+	}
+}
+
+func (h *Argon2idHasher) Hash(password string) (string, error) {
+	salt, err := randomSalt(h.SaltLen)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Time, h.Memory, h.Threads, h.KeyLen)
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		h.Memory,
+		h.Time,
+		h.Threads,
+		encodeB64(salt),
+		encodeB64(key),
+	), nil
+}
+
+func (h *Argon2idHasher) Verify(password, digest string) (bool, error) {
+	params, salt, key, err := parseArgon2id(digest)
+	if err != nil {
+		return false, err
+	}
+	actual := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(actual, key) == 1, nil
+}
+
+func (h *Argon2idHasher) NeedsRehash(digest string) bool {
+	params, salt, key, err := parseArgon2id(digest)
+	if err != nil {
+		return true
+	}
+	return params.Time != h.Time ||
+		params.Memory != h.Memory ||
+		params.Threads != h.Threads ||
+		len(salt) != h.SaltLen ||
+		uint32(len(key)) != h.KeyLen
+}
+
+func parseArgon2id(digest string) (params Argon2idHasher, salt, key []byte, err error) {
+	parts := strings.Split(digest, "$")
+	// "", "argon2id", "v=19", "m=..,t=..,p=..", salt, hash
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, ErrUnsupportedDigest
+	}
+	var version int
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return params, nil, nil, fmt.Errorf("malformed argon2id digest: %w", err)
+	}
+	if version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2 version %d", version)
+	}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads)
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("malformed argon2id digest: %w", err)
+	}
+	// argon2 panics on t or p of zero, and needs at least 8 KiB per thread.
+	if params.Time < 1 || params.Threads < 1 ||
+		params.Memory < 8*uint32(params.Threads) || params.Memory > maxArgon2idMemory {
+		return params, nil, nil, fmt.Errorf("malformed argon2id digest: %s", parts[3])
+	}
+	if salt, err = decodeB64(parts[4]); err != nil {
+		return params, nil, nil, fmt.Errorf("malformed argon2id digest: %w", err)
+	}
+	if key, err = decodeB64(parts[5]); err != nil {
+		return params, nil, nil, fmt.Errorf("malformed argon2id digest: %w", err)
+	}
+	return params, salt, key, nil
+}
+
+type ScryptHasher struct {
+	LogN    int // N = 2^LogN
+	R       int
+	P       int
+	SaltLen int
+	KeyLen  int
+}
+
+func NewScryptHasher() *ScryptHasher {
+	return &ScryptHasher{
+		LogN:    15,
+		R:       8,
+		P:       1,
+		SaltLen: 16,
+		KeyLen:  32,
+	}
+}
+
+func (h *ScryptHasher) Hash(password string) (string, error) {
+	salt, err := randomSalt(h.SaltLen)
+	if err != nil {
+		return "", err
+	}
+	key, err := scrypt.Key([]byte(password), salt, 1<<h.LogN, h.R, h.P, h.KeyLen)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(
+		"$scrypt$ln=%d,r=%d,p=%d$%s$%s",
+		h.LogN,
+		h.R,
+		h.P,
+		encodeB64(salt),
+		encodeB64(key),
+	), nil
+}
+
+func (h *ScryptHasher) Verify(password, digest string) (bool, error) {
+	params, salt, key, err := parseScrypt(digest)
+	if err != nil {
+		return false, err
+	}
+	actual, err := scrypt.Key([]byte(password), salt, 1<<params.LogN, params.R, params.P, len(key))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(actual, key) == 1, nil
+}
+
+func (h *ScryptHasher) NeedsRehash(digest string) bool {
+	params, salt, key, err := parseScrypt(digest)
+	if err != nil {
+		return true
+	}
+	return params.LogN != h.LogN ||
+		params.R != h.R ||
+		params.P != h.P ||
+		len(salt) != h.SaltLen ||
+		len(key) != h.KeyLen
+}
+
+func parseScrypt(digest string) (params ScryptHasher, salt, key []byte, err error) {
+	parts := strings.Split(digest, "$")
+	// "", "scrypt", "ln=..,r=..,p=..", salt, hash
+	if len(parts) != 5 || parts[1] != "scrypt" {
+		return params, nil, nil, ErrUnsupportedDigest
+	}
+	_, err = fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &params.LogN, &params.R, &params.P)
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("malformed scrypt digest: %w", err)
+	}
+	if params.LogN < 1 || params.LogN > 30 {
+		return params, nil, nil, fmt.Errorf("malformed scrypt digest: ln=%d", params.LogN)
+	}
+	if salt, err = decodeB64(parts[3]); err != nil {
+		return params, nil, nil, fmt.Errorf("malformed scrypt digest: %w", err)
+	}
+	if key, err = decodeB64(parts[4]); err != nil {
+		return params, nil, nil, fmt.Errorf("malformed scrypt digest: %w", err)
+	}
+	return params, salt, key, nil
+}
+
+// UpgradingHasher hashes with its preferred algorithm but still verifies
+// digests made by the fallbacks and by the legacy MD5 scheme, flagging them
+// for rehash so they get upgraded the next time the user logs in.
+type UpgradingHasher struct {
+	preferred PasswordHasher
+	fallbacks []PasswordHasher
+}
+
+func NewUpgradingHasher(preferred PasswordHasher, fallbacks ...PasswordHasher) *UpgradingHasher {
+	return &UpgradingHasher{
+		preferred: preferred,
+		fallbacks: fallbacks,
+	}
+}
+
+// NewDefaultPasswordHasher hashes new passwords with argon2id and accepts
+// bcrypt, scrypt and legacy digests.
+func NewDefaultPasswordHasher() *UpgradingHasher {
+	return NewUpgradingHasher(NewArgon2idHasher(), NewBcryptHasher(), NewScryptHasher())
+}
+
+func (h *UpgradingHasher) Hash(password string) (string, error) {
+	return h.preferred.Hash(password)
+}
+
+func (h *UpgradingHasher) Verify(password, digest string) (bool, error) {
+	for _, hasher := range append([]PasswordHasher{h.preferred}, h.fallbacks...) {
+		ok, err := hasher.Verify(password, digest)
+		if errors.Is(err, ErrUnsupportedDigest) {
+			continue
+		}
+		return ok, err
+	}
+	expected := legacyDigest(password)
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(digest)) == 1, nil
+}
+
+func (h *UpgradingHasher) NeedsRehash(digest string) bool {
+	return h.preferred.NeedsRehash(digest)
+}
+
+// Digests stored before PasswordHasher existed were produced by
+// md5.New().Sum(password): the plaintext followed by the MD5 of nothing.
+func legacyDigest(password string) string {
+	return string(md5.New().Sum([]byte(password)))
+}
+
+func randomSalt(n int) ([]byte, error) {
+	salt := make([]byte, n)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+func encodeB64(b []byte) string {
+	return base64.RawStdEncoding.EncodeToString(b)
+}
+
+func decodeB64(s string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(s)
+}
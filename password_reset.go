@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// PasswordReset mails users who forgot their password a token to set a new
+// one with. The token is bound to the password it replaces, so it works once:
+// after the reset, or any other password change, it no longer matches.
+type PasswordReset struct {
+	mailer    Mailer
+	signer    *EmailTokenSigner
+	publicURL string
+	ttl       time.Duration
+}
+
+func NewPasswordReset(mailer Mailer, signer *EmailTokenSigner, publicURL string, ttl time.Duration) *PasswordReset {
+	return &PasswordReset{
+		mailer:    mailer,
+		signer:    signer,
+		publicURL: strings.TrimSuffix(publicURL, "/"),
+		ttl:       ttl,
+	}
+}
+
+type PasswordForgotten struct {
+	Email string `json:"email"`
+}
+
+type PasswordResetParams struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// passwordFingerprint identifies the password digest of user without
+// revealing it.
+func passwordFingerprint(user User) string {
+	return hashToken(user.PasswordDigest)[:16]
+}
+
+func (p *PasswordReset) send(ctx context.Context, user User) error {
+	token, err := p.signer.Sign(emailTokenPasswordReset, user.Email+" "+passwordFingerprint(user), p.ttl)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, mailTimeout)
+	defer cancel()
+	return p.mailer.Send(ctx, MailMessage{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: "Someone asked to reset the password of your account. To choose a new one, POST\n\n" +
+			`{"token": "` + token + `", "password": "<new password>"}` + "\n\nto " +
+			p.publicURL + "/user/password/reset. The token expires in " + p.ttl.String() +
+			" and works once. If you didn't ask for it, ignore this mail.",
+	})
+}
+
+// verify returns the email of the user a reset token was issued to, if the
+// token is still good for the user's current password.
+func (p *PasswordReset) verify(token string, users UserRepository) (User, error) {
+	subject, err := p.signer.Verify(emailTokenPasswordReset, token)
+	if err != nil {
+		return User{}, err
+	}
+	space := strings.LastIndexByte(subject, ' ')
+	if space < 0 {
+		return User{}, ErrEmailTokenInvalid
+	}
+	user, err := users.Get(subject[:space])
+	if errors.Is(err, ErrUserNotFound) {
+		return User{}, ErrEmailTokenInvalid
+	}
+	if err != nil {
+		return User{}, err
+	}
+	if subject[space+1:] != passwordFingerprint(user) {
+		// Used already, or the password changed since.
+		return User{}, ErrEmailTokenInvalid
+	}
+	return user, nil
+}
+
+// ForgotPassword mails a reset token to a registered, unbanned address. It
+// answers the same whether or not one was sent, and sends in the background
+// so that the response time tells nothing either.
+func (us *UserService) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	if us.passwordReset == nil {
+		handleError(newError(ErrBadRequest, "password reset is disabled"), w, r)
+		return
+	}
+	params := &PasswordForgotten{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		handleError(newError(ErrBadRequest, "could not read params"), w, r)
+		return
+	}
+	if err := validateEmail(params.Email); err != nil {
+		handleError(err, w, r)
+		return
+	}
+
+	id := requestID(r)
+	go func() {
+		user, err := us.repository.Get(params.Email)
+		if err != nil || user.Ban.Active(time.Now()) {
+			if err != nil && !errors.Is(err, ErrUserNotFound) {
+				logger.Error("could not look up user for password reset", Fields{"error": err, "request_id": id})
+			}
+			return
+		}
+		ctx := contextWithRequestID(context.Background(), id)
+		if err := us.passwordReset.send(ctx, user); err != nil {
+			logger.Error("could not send password reset mail", Fields{
+				"error":      err,
+				"user":       user.Email,
+				"request_id": id,
+			})
+		}
+	}()
+
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("sent"))
+}
+
+// ResetPassword sets a new password with a token mailed by ForgotPassword and
+// revokes the sessions of the user. Getting the token proves that the user
+// reads mail at the address, so it also counts as verifying it.
+func (us *UserService) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	if us.passwordReset == nil {
+		handleError(newError(ErrBadRequest, "password reset is disabled"), w, r)
+		return
+	}
+	params := &PasswordResetParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		handleError(newError(ErrBadRequest, "could not read params"), w, r)
+		return
+	}
+	user, err := us.passwordReset.verify(params.Token, us.repository)
+	if err != nil {
+		handleError(err, w, r)
+		return
+	}
+	if err := validatePassword(params.Password); err != nil {
+		handleError(err, w, r)
+		return
+	}
+
+	passwordDigest, err := us.hasher.Hash(params.Password)
+	if err != nil {
+		handleError(errors.New("could not hash password"), w, r)
+		return
+	}
+	event, err := newEvent(r, EventUserPasswordChanged, UserPasswordChanged{Email: user.Email, Reason: "reset"})
+	if err != nil {
+		handleError(err, w, r)
+		return
+	}
+	_, err = us.repository.Modify(user.Email, func(stored *User) ([]Event, error) {
+		if stored.PasswordDigest != user.PasswordDigest {
+			// The token was used meanwhile.
+			return nil, ErrEmailTokenInvalid
+		}
+		stored.PasswordDigest = passwordDigest
+		stored.Unverified = false
+		return []Event{event}, nil
+	})
+	if err != nil {
+		handleError(err, w, r)
+		return
+	}
+	us.relay.Notify()
+	us.revokeTokens(user.Email)
+	us.lockout.Clear(user.Email)
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("updated"))
+}
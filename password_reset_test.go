@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+)
+
+var resetToken = regexp.MustCompile(`"token": "([^"]+)"`)
+
+// waitForMail waits for the outbox to hold count messages, as reset mail is
+// sent in the background.
+func waitForMail(t *testing.T, mailer *OutboxMailer, count int) []MailMessage {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		sent := mailer.Messages()
+		if len(sent) >= count || time.Now().After(deadline) {
+			return sent
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	doRequest := createRequester(t)
+	us := newTestUserService()
+	j, err := NewJWTService(DefaultConfig().JWT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	us.tokens = j
+	mailer := NewOutboxMailer("")
+	signer, _ := NewEmailTokenSigner(nil)
+	us.passwordReset = NewPasswordReset(mailer, signer, "https://cake.test", time.Hour)
+	digest, _ := us.hasher.Hash("oldpassword")
+	user := User{Email: "cake@mail.com", PasswordDigest: digest, Role: RoleUser}
+	us.repository.Add(user.Email, user)
+	session, _ := j.GenearateJWT(user)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/user/password/forgot", us.ForgotPassword)
+	mux.HandleFunc("/user/password/reset", us.ResetPassword)
+	mux.HandleFunc("/user/me", j.AuthenticationJWT(us.repository, us.GetCake))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	forgot := func(email string) parsedResponse {
+		params := map[string]interface{}{"email": email}
+		return doRequest(http.NewRequest(http.MethodPost, ts.URL+"/user/password/forgot", prepareParams(t, params)))
+	}
+	reset := func(token, password string) parsedResponse {
+		params := map[string]interface{}{"token": token, "password": password}
+		return doRequest(http.NewRequest(http.MethodPost, ts.URL+"/user/password/reset", prepareParams(t, params)))
+	}
+
+	resp := forgot("nobody@mail.com")
+	assertStatus(t, 202, resp)
+	assertBody(t, "sent", resp)
+	assertStatus(t, 202, forgot("cake@mail.com"))
+	sent := waitForMail(t, mailer, 1)
+	if len(sent) != 1 || sent[0].To != "cake@mail.com" {
+		t.Fatalf("unexpected mail: %+v", sent)
+	}
+	match := resetToken.FindStringSubmatch(sent[0].Body)
+	if match == nil {
+		t.Fatalf("no token in %q", sent[0].Body)
+	}
+	token := match[1]
+
+	assertStatus(t, 400, reset("forged", "newpassword"))
+	assertStatus(t, 422, reset(token, "short"))
+	assertStatus(t, 200, reset(token, "newpassword"))
+
+	stored, _ := us.repository.Get("cake@mail.com")
+	if ok, _ := us.hasher.Verify("newpassword", stored.PasswordDigest); !ok {
+		t.Error("password was not changed")
+	}
+	request, err := http.NewRequest(http.MethodGet, ts.URL+"/user/me", nil)
+	request.Header.Set("Authorization", "Bearer "+session)
+	assertStatus(t, 401, doRequest(request, err))
+
+	resp = reset(token, "thirdpassword")
+	assertProblem(t, 400, "invalid or expired token", resp)
+}
+
+func TestForgotPasswordSkipsBannedUsers(t *testing.T) {
+	doRequest := createRequester(t)
+	us := newTestUserService()
+	mailer := NewOutboxMailer("")
+	signer, _ := NewEmailTokenSigner(nil)
+	us.passwordReset = NewPasswordReset(mailer, signer, "https://cake.test", time.Hour)
+	us.repository.Add("banned@mail.com", User{
+		Email: "banned@mail.com",
+		Role:  RoleUser,
+		Ban:   Ban{BannedAt: time.Now(), Reason: "spam"},
+	})
+	ts := httptest.NewServer(http.HandlerFunc(us.ForgotPassword))
+	defer ts.Close()
+
+	params := map[string]interface{}{"email": "banned@mail.com"}
+	assertStatus(t, 202, doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params))))
+	if sent := waitForMail(t, mailer, 1); len(sent) != 0 {
+		t.Errorf("mailed a banned user: %+v", sent)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/md5"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func fastHashers() map[string]PasswordHasher {
+	return map[string]PasswordHasher{
+		"bcrypt":   &BcryptHasher{Cost: bcrypt.MinCost},
+		"argon2id": &Argon2idHasher{Time: 1, Memory: 64, Threads: 1, SaltLen: 16, KeyLen: 32},
+		"scrypt":   &ScryptHasher{LogN: 4, R: 8, P: 1, SaltLen: 16, KeyLen: 32},
+	}
+}
+
+func TestPasswordHashers(t *testing.T) {
+	for name, hasher := range fastHashers() {
+		t.Run(name, func(t *testing.T) {
+			digest, err := hasher.Hash("qwerty123")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(digest, "$") {
+				t.Errorf("digest is not PHC encoded: %s", digest)
+			}
+			if ok, err := hasher.Verify("qwerty123", digest); err != nil || !ok {
+				t.Errorf("Verify(valid) = %v, %v; want true, nil", ok, err)
+			}
+			if ok, err := hasher.Verify("qwerty124", digest); err != nil || ok {
+				t.Errorf("Verify(invalid) = %v, %v; want false, nil", ok, err)
+			}
+			if hasher.NeedsRehash(digest) {
+				t.Errorf("NeedsRehash(own digest) = true; want false")
+			}
+		})
+	}
+}
+
+func TestPasswordHasherRejectsForeignDigest(t *testing.T) {
+	hashers := fastHashers()
+	digest, _ := hashers["bcrypt"].Hash("qwerty123")
+	for _, name := range []string{"argon2id", "scrypt"} {
+		if _, err := hashers[name].Verify("qwerty123", digest); err != ErrUnsupportedDigest {
+			t.Errorf("%s: Verify(bcrypt digest) err = %v; want ErrUnsupportedDigest", name, err)
+		}
+		if !hashers[name].NeedsRehash(digest) {
+			t.Errorf("%s: NeedsRehash(bcrypt digest) = false; want true", name)
+		}
+	}
+}
+
+func TestArgon2idRejectsUnsafeParameters(t *testing.T) {
+	hasher := fastHashers()["argon2id"]
+	for _, params := range []string{"m=64,t=0,p=1", "m=64,t=1,p=0", "m=4,t=1,p=1", "m=4294967295,t=1,p=1"} {
+		digest := "$argon2id$v=19$" + params + "$c2FsdHNhbHRzYWx0c2FsdA$a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U"
+		if ok, err := hasher.Verify("qwerty123", digest); err == nil || ok {
+			t.Errorf("Verify(%s) = %v, %v; want an error", params, ok, err)
+		}
+		if !hasher.NeedsRehash(digest) {
+			t.Errorf("NeedsRehash(%s) = false; want true", params)
+		}
+	}
+}
+
+func TestNeedsRehashOnCostChange(t *testing.T) {
+	old := &ScryptHasher{LogN: 4, R: 8, P: 1, SaltLen: 16, KeyLen: 32}
+	digest, _ := old.Hash("qwerty123")
+	stronger := &ScryptHasher{LogN: 5, R: 8, P: 1, SaltLen: 16, KeyLen: 32}
+	if !stronger.NeedsRehash(digest) {
+		t.Errorf("NeedsRehash = false; want true after raising the cost")
+	}
+	if ok, err := stronger.Verify("qwerty123", digest); err != nil || !ok {
+		t.Errorf("Verify(old cost digest) = %v, %v; want true, nil", ok, err)
+	}
+}
+
+func TestUpgradingHasher(t *testing.T) {
+	hashers := fastHashers()
+	hasher := NewUpgradingHasher(hashers["argon2id"], hashers["bcrypt"], hashers["scrypt"])
+
+	digests := map[string]string{
+		"legacy": string(md5.New().Sum([]byte("qwerty123"))),
+	}
+	digests["bcrypt"], _ = hashers["bcrypt"].Hash("qwerty123")
+	digests["scrypt"], _ = hashers["scrypt"].Hash("qwerty123")
+	for name, digest := range digests {
+		if ok, err := hasher.Verify("qwerty123", digest); err != nil || !ok {
+			t.Errorf("%s: Verify = %v, %v; want true, nil", name, ok, err)
+		}
+		if ok, _ := hasher.Verify("wrong", digest); ok {
+			t.Errorf("%s: Verify(wrong password) = true; want false", name)
+		}
+		if !hasher.NeedsRehash(digest) {
+			t.Errorf("%s: NeedsRehash = false; want true", name)
+		}
+	}
+
+	digest, _ := hasher.Hash("qwerty123")
+	if !strings.HasPrefix(digest, "$argon2id$") {
+		t.Errorf("Hash = %s; want argon2id digest", digest)
+	}
+	if hasher.NeedsRehash(digest) {
+		t.Errorf("NeedsRehash(preferred digest) = true; want false")
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const rateLimitPruneInterval = time.Minute
+
+var (
+	ErrRateLimited   = newError(ErrTooManyRequests, "rate limit exceeded, slow down")
+	ErrAccountLocked = newError(ErrTooManyRequests, "too many failed logins, try again later")
+)
+
+var rateLimitedTotal = metrics.NewCounterVec(
+	"rate_limited_requests_total",
+	"Requests turned away by a rate limit, by what they were limited on.",
+	"key",
+)
+
+// RateLimiter keeps a token bucket per key. Each bucket holds up to burst
+// tokens and refills at rate tokens per second; a request takes one.
+type RateLimiter struct {
+	lock      sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+	now       func() time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+// Allow takes a token for key. When there is none it tells how long until
+// there will be.
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.now()
+	l.pruneLocked(now)
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, updated: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*l.rate)
+	bucket.updated = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// pruneLocked forgets buckets that have refilled: a new one starts full anyway.
+func (l *RateLimiter) pruneLocked(now time.Time) {
+	if now.Sub(l.lastPrune) < rateLimitPruneInterval {
+		return
+	}
+	l.lastPrune = now
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.updated).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// RateLimits throttles clients by IP address and, on the endpoints that take
+// an email, by the account they target, so that spreading guesses over many
+// addresses doesn't help either. A nil limiter doesn't limit.
+type RateLimits struct {
+	byIP    *RateLimiter
+	byEmail *RateLimiter
+	// exempt route templates, such as the probes of a load balancer.
+	exempt map[string]bool
+}
+
+func NewRateLimits(config RateLimitConfig) *RateLimits {
+	limits := &RateLimits{exempt: map[string]bool{
+		"/healthz": true,
+		"/readyz":  true,
+		"/metrics": true,
+	}}
+	if config.IP.Rate > 0 {
+		limits.byIP = NewRateLimiter(config.IP.Rate, config.IP.Burst)
+	}
+	if config.Email.Rate > 0 {
+		limits.byEmail = NewRateLimiter(config.Email.Rate, config.Email.Burst)
+	}
+	return limits
+}
+
+// LimitIP is router middleware limiting every client address.
+func (rl *RateLimits) LimitIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rl.byIP == nil || rl.exemptRoute(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if ok, wait := rl.byIP.Allow(clientIP(r)); !ok {
+			rateLimitedTotal.Inc("ip")
+			handleError(&RetryAfterError{Err: ErrRateLimited, After: wait}, w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// LimitEmail limits requests by the email in their JSON body.
+func (rl *RateLimits) LimitEmail(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if rl.byEmail == nil {
+			h(w, r)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			handleError(newError(ErrBadRequest, "could not read request"), w, r)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		var params struct {
+			Email string `json:"email"`
+		}
+		// Malformed bodies are left for the handler to reject.
+		json.Unmarshal(body, &params)
+		if email := normalizeEmail(params.Email); email != "" {
+			if ok, wait := rl.byEmail.Allow(email); !ok {
+				rateLimitedTotal.Inc("email")
+				handleError(&RetryAfterError{Err: ErrRateLimited, After: wait}, w, r)
+				return
+			}
+		}
+		h(w, r)
+	}
+}
+
+func (rl *RateLimits) exemptRoute(r *http.Request) bool {
+	if route := mux.CurrentRoute(r); route != nil {
+		template, err := route.GetPathTemplate()
+		return err == nil && rl.exempt[template]
+	}
+	return false
+}
+
+// clientIP is the address the connection comes from. Forwarding headers are
+// not trusted: anyone can set them to get a fresh bucket.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// LoginLockout locks an account out of password logins after threshold
+// consecutive failures. Each further failure doubles the lockout, up to
+// maxDuration; a successful login or an admin clears the count. A nil
+// LoginLockout never locks.
+type LoginLockout struct {
+	lock        sync.Mutex
+	threshold   int
+	duration    time.Duration
+	maxDuration time.Duration
+	accounts    map[string]*loginFailures
+	lastPrune   time.Time
+	now         func() time.Time
+}
+
+type loginFailures struct {
+	consecutive int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+func NewLoginLockout(threshold int, duration, maxDuration time.Duration) *LoginLockout {
+	return &LoginLockout{
+		threshold:   threshold,
+		duration:    duration,
+		maxDuration: maxDuration,
+		accounts:    make(map[string]*loginFailures),
+		now:         time.Now,
+	}
+}
+
+// Locked tells how long the account stays locked, zero when it isn't.
+func (l *LoginLockout) Locked(email string) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	failures, ok := l.accounts[normalizeEmail(email)]
+	if !ok {
+		return 0
+	}
+	if wait := failures.lockedUntil.Sub(l.now()); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// Fail records a failed login and returns the lockout it started, if any.
+func (l *LoginLockout) Fail(email string) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.now()
+	l.pruneLocked(now)
+	key := normalizeEmail(email)
+	failures, ok := l.accounts[key]
+	if !ok || l.expired(failures, now) {
+		failures = &loginFailures{}
+		l.accounts[key] = failures
+	}
+	failures.consecutive++
+	failures.lastFailure = now
+	if failures.consecutive < l.threshold {
+		return 0
+	}
+	lockout := l.duration
+	for i := l.threshold; i < failures.consecutive && lockout < l.maxDuration; i++ {
+		lockout *= 2
+	}
+	if lockout > l.maxDuration {
+		lockout = l.maxDuration
+	}
+	failures.lockedUntil = now.Add(lockout)
+	return lockout
+}
+
+func (l *LoginLockout) Succeed(email string) {
+	l.Clear(email)
+}
+
+// Clear forgets the failures of the account and lifts its lockout.
+func (l *LoginLockout) Clear(email string) {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.accounts, normalizeEmail(email))
+}
+
+// expired tells whether the account has been quiet for the longest lockout;
+// failures only count as consecutive within that window.
+func (l *LoginLockout) expired(failures *loginFailures, now time.Time) bool {
+	return now.After(failures.lockedUntil) && now.Sub(failures.lastFailure) > l.maxDuration
+}
+
+// pruneLocked forgets expired accounts. It scans them all, so it does so at
+// most once per interval rather than on every failed login.
+func (l *LoginLockout) pruneLocked(now time.Time) {
+	if now.Sub(l.lastPrune) < rateLimitPruneInterval {
+		return
+	}
+	l.lastPrune = now
+	for key, failures := range l.accounts {
+		if l.expired(failures, now) {
+			delete(l.accounts, key)
+		}
+	}
+}
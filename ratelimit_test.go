@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	limiter := NewRateLimiter(2, 3)
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := limiter.Allow("a"); !ok {
+			t.Fatalf("request %d of the burst refused", i+1)
+		}
+	}
+	ok, wait := limiter.Allow("a")
+	if ok || wait != 500*time.Millisecond {
+		t.Errorf("got %v, %v; want refused for 500ms", ok, wait)
+	}
+	if ok, _ := limiter.Allow("b"); !ok {
+		t.Error("another key shares the bucket")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ := limiter.Allow("a"); !ok {
+		t.Error("bucket didn't refill")
+	}
+
+	now = now.Add(time.Hour)
+	limiter.Allow("c")
+	if _, ok := limiter.buckets["a"]; ok {
+		t.Error("refilled bucket wasn't pruned")
+	}
+}
+
+func TestLimitIP(t *testing.T) {
+	limits := NewRateLimits(RateLimitConfig{IP: RateConfig{Rate: 0.5, Burst: 1}})
+	r := mux.NewRouter()
+	r.HandleFunc("/cake", func(w http.ResponseWriter, r *http.Request) {})
+	r.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {})
+	r.Use(limits.LimitIP)
+
+	request := func(path, addr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = addr
+		req.Header.Set("X-Forwarded-For", strconv.Itoa(int(time.Now().UnixNano())))
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := request("/cake", "10.0.0.1:1000"); rec.Code != http.StatusOK {
+		t.Fatalf("first request: %d", rec.Code)
+	}
+	rec := request("/cake", "10.0.0.1:2000")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "2" {
+		t.Errorf("got %d, Retry-After %q; want 429 after 2s", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if !strings.Contains(rec.Body.String(), "/problems/too-many-requests") {
+		t.Errorf("unexpected body: %s", rec.Body)
+	}
+	if rec := request("/cake", "10.0.0.2:1000"); rec.Code != http.StatusOK {
+		t.Errorf("other address: %d", rec.Code)
+	}
+	for i := 0; i < 3; i++ {
+		if rec := request("/healthz", "10.0.0.1:1000"); rec.Code != http.StatusOK {
+			t.Errorf("probe limited: %d", rec.Code)
+		}
+	}
+}
+
+func TestLimitEmail(t *testing.T) {
+	limits := NewRateLimits(RateLimitConfig{Email: RateConfig{Rate: 1, Burst: 1}})
+	var bodies []string
+	handler := limits.LimitEmail(func(w http.ResponseWriter, r *http.Request) {
+		var body bytes.Buffer
+		body.ReadFrom(r.Body)
+		bodies = append(bodies, body.String())
+	})
+	request := func(body string) int {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodPost, "/user/jwt", strings.NewReader(body)))
+		return rec.Code
+	}
+	if code := request(`{"email":"cake@mail.com","password":"1"}`); code != http.StatusOK {
+		t.Fatalf("first request: %d", code)
+	}
+	if len(bodies) != 1 || bodies[0] != `{"email":"cake@mail.com","password":"1"}` {
+		t.Errorf("handler got %q; want the body untouched", bodies)
+	}
+	if code := request(`{"email":" Cake@Mail.com ","password":"2"}`); code != http.StatusTooManyRequests {
+		t.Errorf("same account from another spelling: %d", code)
+	}
+	if code := request(`{"email":"pie@mail.com","password":"2"}`); code != http.StatusOK {
+		t.Errorf("other account: %d", code)
+	}
+	if code := request(`not json`); code != http.StatusOK {
+		t.Errorf("malformed body not left to the handler: %d", code)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	now := time.Unix(0, 0)
+	lockout := NewLoginLockout(3, time.Minute, 3*time.Minute)
+	lockout.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if d := lockout.Fail("cake@mail.com"); d != 0 {
+			t.Fatalf("failure %d locked for %v", i+1, d)
+		}
+	}
+	for _, want := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		if d := lockout.Fail("cake@mail.com"); d != want {
+			t.Errorf("locked for %v; want %v", d, want)
+		}
+	}
+	now = now.Add(time.Minute)
+	if d := lockout.Locked("CAKE@mail.com"); d != 2*time.Minute {
+		t.Errorf("remaining lockout %v; want 2m", d)
+	}
+	lockout.Clear("cake@mail.com")
+	if d := lockout.Locked("cake@mail.com"); d != 0 {
+		t.Errorf("still locked after clearing: %v", d)
+	}
+	if d := lockout.Fail("cake@mail.com"); d != 0 {
+		t.Errorf("failures counted from before clearing: %v", d)
+	}
+
+	// Failures older than the longest lockout don't count, whether or not
+	// they have been pruned yet.
+	lockout.Fail("cake@mail.com")
+	now = now.Add(3*time.Minute + time.Second)
+	lockout.lastPrune = now
+	if d := lockout.Fail("cake@mail.com"); d != 0 {
+		t.Errorf("stale failures counted: %v", d)
+	}
+	lockout.Fail("cake@mail.com")
+	if d := lockout.Fail("cake@mail.com"); d != time.Minute {
+		t.Errorf("locked for %v after three fresh failures; want 1m", d)
+	}
+	now = now.Add(rateLimitPruneInterval + 4*time.Minute)
+	lockout.Fail("other@mail.com")
+	if _, ok := lockout.accounts["cake@mail.com"]; ok {
+		t.Error("quiet account not pruned")
+	}
+
+	var disabled *LoginLockout
+	disabled.Fail("cake@mail.com")
+	if disabled.Locked("cake@mail.com") != 0 {
+		t.Error("nil lockout locked")
+	}
+}
+
+func TestLoginLockoutInJWT(t *testing.T) {
+	doRequest := createRequester(t)
+	us, _, ts, adminJWT := newAdminServer(t)
+	defer ts.Close()
+	us.lockout = NewLoginLockout(2, time.Minute, time.Hour)
+	digest, _ := us.hasher.Hash("cakepass")
+	us.repository.Add("cake@mail.com", User{Email: "cake@mail.com", PasswordDigest: digest, Role: RoleUser})
+
+	login := func(password string) parsedResponse {
+		params := map[string]interface{}{"email": "cake@mail.com", "password": password}
+		return doRequest(http.NewRequest(http.MethodPost, ts.URL+"/user/jwt", prepareParams(t, params)))
+	}
+	assertStatus(t, 401, login("wrongpass"))
+	assertStatus(t, 401, login("wrongpass"))
+	resp := login("cakepass")
+	assertStatus(t, 429, resp)
+	assertProblem(t, 429, "too many failed logins, try again later", resp)
+
+	request, err := http.NewRequest(http.MethodDelete, ts.URL+"/admin/users/cake@mail.com/lockout", nil)
+	request.Header.Set("Authorization", "Bearer "+adminJWT)
+	assertStatus(t, 200, doRequest(request, err))
+	assertStatus(t, 200, login("cakepass"))
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+var (
+	ErrRefreshTokenInvalid = newError(ErrUnauthorized, "invalid refresh token")
+	ErrRefreshTokenReused  = newError(ErrUnauthorized, "refresh token reuse detected")
+)
+
+// RefreshTokenStore keeps opaque refresh tokens. Every token belongs to a
+// family started at login; rotating a token retires it and hands out its
+// successor in the same family. Presenting a retired token again means it has
+// leaked, so the whole family is revoked.
+type RefreshTokenStore interface {
+	Issue(email string, ttl time.Duration) (string, error)
+	Rotate(token string, ttl time.Duration) (string, string, error)
+	RevokeFamily(email, token string) error
+	RevokeUser(email string)
+}
+
+type refreshTokenRecord struct {
+	email     string
+	family    string
+	expiresAt time.Time
+	used      bool
+}
+
+type InMemoryRefreshTokenStore struct {
+	lock     sync.Mutex
+	tokens   map[string]*refreshTokenRecord
+	families map[string]bool // family -> revoked
+	now      func() time.Time
+}
+
+func NewInMemoryRefreshTokenStore() *InMemoryRefreshTokenStore {
+	return &InMemoryRefreshTokenStore{
+		tokens:   make(map[string]*refreshTokenRecord),
+		families: make(map[string]bool),
+		now:      time.Now,
+	}
+}
+
+// Issue starts a new token family for the user and returns its first token.
+func (s *InMemoryRefreshTokenStore) Issue(email string, ttl time.Duration) (string, error) {
+	family, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.pruneLocked()
+	s.families[family] = false
+	return s.issueLocked(email, family, ttl)
+}
+
+// Rotate retires token and returns its successor along with the owner's email.
+func (s *InMemoryRefreshTokenStore) Rotate(token string, ttl time.Duration) (string, string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	record, ok := s.tokens[hashToken(token)]
+	if !ok || s.families[record.family] || !s.now().Before(record.expiresAt) {
+		return "", "", ErrRefreshTokenInvalid
+	}
+	if record.used {
+		s.families[record.family] = true
+		return "", "", ErrRefreshTokenReused
+	}
+	record.used = true
+	next, err := s.issueLocked(record.email, record.family, ttl)
+	if err != nil {
+		return "", "", err
+	}
+	return next, record.email, nil
+}
+
+// RevokeFamily revokes token together with every token rotated from the same
+// login. Only the user the token was issued to may revoke it; anyone else gets
+// ErrRefreshTokenInvalid, as for a token that doesn't exist.
+func (s *InMemoryRefreshTokenStore) RevokeFamily(email, token string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	record, ok := s.tokens[hashToken(token)]
+	if !ok || record.email != email {
+		return ErrRefreshTokenInvalid
+	}
+	s.families[record.family] = true
+	return nil
+}
+
+// RevokeUser revokes every token family of the user.
+func (s *InMemoryRefreshTokenStore) RevokeUser(email string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, record := range s.tokens {
+		if record.email == email {
+			s.families[record.family] = true
+		}
+	}
+}
+
+func (s *InMemoryRefreshTokenStore) issueLocked(email, family string, ttl time.Duration) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	s.tokens[hashToken(token)] = &refreshTokenRecord{
+		email:     email,
+		family:    family,
+		expiresAt: s.now().Add(ttl),
+	}
+	return token, nil
+}
+
+// pruneLocked forgets expired tokens and families left without any token.
+// Used tokens are kept until they expire so that replaying them is detected.
+func (s *InMemoryRefreshTokenStore) pruneLocked() {
+	now := s.now()
+	alive := make(map[string]bool)
+	for key, record := range s.tokens {
+		if !now.Before(record.expiresAt) {
+			delete(s.tokens, key)
+			continue
+		}
+		alive[record.family] = true
+	}
+	for family := range s.families {
+		if !alive[family] {
+			delete(s.families, family)
+		}
+	}
+}
+
+// Only digests of refresh tokens are kept, so a dump of the store can't be
+// used to impersonate anyone.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
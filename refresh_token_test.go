@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRefreshTokenRotation(t *testing.T) {
+	store := NewInMemoryRefreshTokenStore()
+	first, err := store.Issue("myemail@gmail.com", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, email, err := store.Rotate(first, time.Hour)
+	if err != nil {
+		t.Fatalf("Rotate(first) = %s; want nil", err)
+	}
+	if email != "myemail@gmail.com" {
+		t.Errorf("Rotate(first) email = %s; want myemail@gmail.com", email)
+	}
+	if second == first {
+		t.Error("Rotate returned the same token")
+	}
+	if _, _, err := store.Rotate(second, time.Hour); err != nil {
+		t.Errorf("Rotate(second) = %s; want nil", err)
+	}
+}
+
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+	store := NewInMemoryRefreshTokenStore()
+	first, _ := store.Issue("myemail@gmail.com", time.Hour)
+	second, _, _ := store.Rotate(first, time.Hour)
+
+	if _, _, err := store.Rotate(first, time.Hour); err != ErrRefreshTokenReused {
+		t.Errorf("Rotate(first) again = %v; want ErrRefreshTokenReused", err)
+	}
+	if _, _, err := store.Rotate(second, time.Hour); err != ErrRefreshTokenInvalid {
+		t.Errorf("Rotate(second) after reuse = %v; want ErrRefreshTokenInvalid", err)
+	}
+
+	other, _ := store.Issue("myemail@gmail.com", time.Hour)
+	if _, _, err := store.Rotate(other, time.Hour); err != nil {
+		t.Errorf("Rotate(other family) = %s; want nil", err)
+	}
+}
+
+func TestRefreshTokenExpiry(t *testing.T) {
+	store := NewInMemoryRefreshTokenStore()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	token, _ := store.Issue("myemail@gmail.com", time.Minute)
+
+	now = now.Add(2 * time.Minute)
+	if _, _, err := store.Rotate(token, time.Minute); err != ErrRefreshTokenInvalid {
+		t.Errorf("Rotate(expired) = %v; want ErrRefreshTokenInvalid", err)
+	}
+	store.Issue("myemail@gmail.com", time.Minute)
+	if len(store.tokens) != 1 || len(store.families) != 1 {
+		t.Errorf("expired tokens were not pruned: %d tokens, %d families", len(store.tokens), len(store.families))
+	}
+}
+
+func TestRefreshTokenUnknown(t *testing.T) {
+	store := NewInMemoryRefreshTokenStore()
+	if _, _, err := store.Rotate("nope", time.Hour); err != ErrRefreshTokenInvalid {
+		t.Errorf("Rotate(unknown) = %v; want ErrRefreshTokenInvalid", err)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	handler := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestID(r)
+	}))
+
+	tests := []struct {
+		name     string
+		incoming string
+		keep     bool
+	}{
+		{"accepted", "abc-123_x.y:z", true},
+		{"missing", "", false},
+		{"invalid characters", "abc def\n", false},
+		{"too long", strings.Repeat("a", maxRequestIDLen+1), false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tc.incoming != "" {
+				req.Header.Set(requestIDHeader, tc.incoming)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			echoed := rec.Header().Get(requestIDHeader)
+			if echoed == "" || echoed != seen {
+				t.Errorf("echoed %q, handler saw %q", echoed, seen)
+			}
+			if tc.keep && seen != tc.incoming {
+				t.Errorf("got %q, want %q", seen, tc.incoming)
+			}
+			if !tc.keep && (seen == tc.incoming || !validRequestID(seen)) {
+				t.Errorf("got %q, want a generated ID", seen)
+			}
+		})
+	}
+}
+
+func TestRequestIDInAccessLog(t *testing.T) {
+	var out strings.Builder
+	access := NewAccessLog(NewLogger(&out, LevelInfo))
+	handler := withRequestID(access.Wrap(func(w http.ResponseWriter, r *http.Request) {}))
+	req := httptest.NewRequest(http.MethodGet, "/cake", nil)
+	req.Header.Set(requestIDHeader, "req-42")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if !strings.Contains(out.String(), `"request_id":"req-42"`) {
+		t.Errorf("log line without request ID: %s", out.String())
+	}
+}
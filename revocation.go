@@ -0,0 +1,86 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// RevocationStore remembers access tokens, by their jti, that must be
+// rejected before they expire. Issued tokens are tracked per user so that all
+// of them can be revoked at once, e.g. after a password change.
+type RevocationStore interface {
+	Track(email, jti string, expiresAt time.Time)
+	Revoke(jti string, expiresAt time.Time)
+	RevokeUser(email string)
+	IsRevoked(jti string) bool
+}
+
+type InMemoryRevocationStore struct {
+	lock    sync.RWMutex
+	revoked map[string]time.Time
+	issued  map[string]map[string]time.Time // email -> jti -> expiry
+	now     func() time.Time
+}
+
+func NewInMemoryRevocationStore() *InMemoryRevocationStore {
+	return &InMemoryRevocationStore{
+		revoked: make(map[string]time.Time),
+		issued:  make(map[string]map[string]time.Time),
+		now:     time.Now,
+	}
+}
+
+func (s *InMemoryRevocationStore) Track(email, jti string, expiresAt time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.pruneLocked()
+	tokens, ok := s.issued[email]
+	if !ok {
+		tokens = make(map[string]time.Time)
+		s.issued[email] = tokens
+	}
+	tokens[jti] = expiresAt
+}
+
+func (s *InMemoryRevocationStore) Revoke(jti string, expiresAt time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.revoked[jti] = expiresAt
+}
+
+func (s *InMemoryRevocationStore) RevokeUser(email string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for jti, expiresAt := range s.issued[email] {
+		s.revoked[jti] = expiresAt
+	}
+	delete(s.issued, email)
+}
+
+func (s *InMemoryRevocationStore) IsRevoked(jti string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	_, ok := s.revoked[jti]
+	return ok
+}
+
+// pruneLocked drops tokens that expired: signature validation rejects them
+// anyway, so there is no need to remember them.
+func (s *InMemoryRevocationStore) pruneLocked() {
+	now := s.now()
+	for jti, expiresAt := range s.revoked {
+		if !now.Before(expiresAt) {
+			delete(s.revoked, jti)
+		}
+	}
+	for email, tokens := range s.issued {
+		for jti, expiresAt := range tokens {
+			if !now.Before(expiresAt) {
+				delete(tokens, jti)
+			}
+		}
+		if len(tokens) == 0 {
+			delete(s.issued, email)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRevokeToken(t *testing.T) {
+	store := NewInMemoryRevocationStore()
+	store.Revoke("jti-1", time.Now().Add(time.Hour))
+	if !store.IsRevoked("jti-1") {
+		t.Error("IsRevoked(jti-1) = false; want true")
+	}
+	if store.IsRevoked("jti-2") {
+		t.Error("IsRevoked(jti-2) = true; want false")
+	}
+}
+
+func TestRevokeUserTokens(t *testing.T) {
+	store := NewInMemoryRevocationStore()
+	expiresAt := time.Now().Add(time.Hour)
+	store.Track("myemail@gmail.com", "jti-1", expiresAt)
+	store.Track("myemail@gmail.com", "jti-2", expiresAt)
+	store.Track("other@gmail.com", "jti-3", expiresAt)
+
+	store.RevokeUser("myemail@gmail.com")
+	for _, jti := range []string{"jti-1", "jti-2"} {
+		if !store.IsRevoked(jti) {
+			t.Errorf("IsRevoked(%s) = false; want true", jti)
+		}
+	}
+	if store.IsRevoked("jti-3") {
+		t.Error("IsRevoked(jti-3) = true; want false")
+	}
+}
+
+func TestRevocationPrunesExpiredTokens(t *testing.T) {
+	store := NewInMemoryRevocationStore()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	store.Revoke("jti-1", now.Add(time.Minute))
+	store.Track("myemail@gmail.com", "jti-2", now.Add(time.Minute))
+
+	now = now.Add(2 * time.Minute)
+	store.Track("myemail@gmail.com", "jti-3", now.Add(time.Minute))
+	if len(store.revoked) != 0 {
+		t.Errorf("expired revocations were not pruned: %v", store.revoked)
+	}
+	if len(store.issued["myemail@gmail.com"]) != 1 {
+		t.Errorf("expired tokens were not pruned: %v", store.issued)
+	}
+}
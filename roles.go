@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+)
+
+type Role string
+
+const (
+	RoleUser       Role = "user"
+	RoleAdmin      Role = "admin"
+	RoleSuperAdmin Role = "superadmin"
+)
+
+// Every role is granted whatever the roles ranked below it are.
+var roleRank = map[Role]int{
+	RoleUser:       1,
+	RoleAdmin:      2,
+	RoleSuperAdmin: 3,
+}
+
+func (r Role) Valid() bool {
+	_, ok := roleRank[r]
+	return ok
+}
+
+// Effective maps users stored before roles existed to RoleUser.
+func (r Role) Effective() Role {
+	if r == "" {
+		return RoleUser
+	}
+	return r
+}
+
+// Includes reports whether r is granted everything other is.
+func (r Role) Includes(other Role) bool {
+	return roleRank[r.Effective()] >= roleRank[other.Effective()]
+}
+
+// RequireRole lets the request through only for users holding at least role.
+// The role is taken from the stored user rather than from the token so that a
+// demotion applies immediately.
+func RequireRole(role Role, prHandler ProtectedHandler) ProtectedHandler {
+	return func(rw http.ResponseWriter, r *http.Request, u User) {
+		if !u.Role.Includes(role) {
+			handleError(ErrForbidden, rw, r)
+			return
+		}
+		prHandler(rw, r, u)
+	}
+}
+
+// AuthorizationJWT is AuthenticationJWT restricted to users holding at least role.
+func (j *JWTService) AuthorizationJWT(
+	users UserRepository,
+	role Role,
+	prHandler ProtectedHandler,
+) http.HandlerFunc {
+	return j.AuthenticationJWT(users, RequireRole(role, prHandler))
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRoleIncludes(t *testing.T) {
+	cases := []struct {
+		role, other Role
+		want        bool
+	}{
+		{RoleSuperAdmin, RoleAdmin, true},
+		{RoleAdmin, RoleAdmin, true},
+		{RoleAdmin, RoleSuperAdmin, false},
+		{RoleUser, RoleAdmin, false},
+		{"", RoleUser, true},
+		{"", RoleAdmin, false},
+	}
+	for _, c := range cases {
+		if got := c.role.Includes(c.other); got != c.want {
+			t.Errorf("Role(%q).Includes(%q) = %v; want %v", c.role, c.other, got, c.want)
+		}
+	}
+}
+
+func TestAuthorizationJWT(t *testing.T) {
+	doRequest := createRequester(t)
+	ok := func(rw http.ResponseWriter, r *http.Request, u User) {
+		rw.Write([]byte("ok"))
+	}
+
+	for role, status := range map[Role]int{
+		RoleUser:       403,
+		RoleAdmin:      200,
+		RoleSuperAdmin: 200,
+	} {
+		t.Run(string(role), func(t *testing.T) {
+			us := newTestUserService()
+			j, err := NewJWTService(DefaultConfig().JWT)
+			if err != nil {
+				t.FailNow()
+			}
+			user := User{Email: "email@gmail.com", Role: role}
+			us.repository.Add(user.Email, user)
+			jwt, _ := j.GenearateJWT(user)
+
+			ts := httptest.NewServer(j.AuthorizationJWT(us.repository, RoleAdmin, ok))
+			defer ts.Close()
+			request, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+			request.Header.Set("Authorization", "Bearer "+jwt)
+			resp := doRequest(request, err)
+			assertStatus(t, status, resp)
+		})
+	}
+}
+
+func TestTokenCarriesRole(t *testing.T) {
+	j, _ := NewJWTService(DefaultConfig().JWT)
+	token, _ := j.GenearateJWT(User{Email: "email@gmail.com", Role: RoleAdmin})
+	auth, err := j.ParseJWT(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.Role != string(RoleAdmin) {
+		t.Errorf("role claim = %s; want admin", auth.Role)
+	}
+}
+
+func TestUpdateRole(t *testing.T) {
+	doRequest := createRequester(t)
+
+	us := newTestUserService()
+	j, err := NewJWTService(DefaultConfig().JWT)
+	if err != nil {
+		t.FailNow()
+	}
+	us.tokens = j
+	admin := User{Email: "admin@gmail.com", Role: RoleSuperAdmin}
+	target := User{Email: "email@gmail.com", Role: RoleUser}
+	us.repository.Add(admin.Email, admin)
+	us.repository.Add(target.Email, target)
+	adminJWT, _ := j.GenearateJWT(admin)
+	targetJWT, _ := j.GenearateJWT(target)
+
+	ts := httptest.NewServer(j.AuthorizationJWT(us.repository, RoleSuperAdmin, us.UpdateRole))
+	defer ts.Close()
+
+	t.Run("promotes user", func(t *testing.T) {
+		params := map[string]interface{}{"email": target.Email, "role": "admin"}
+		request, err := http.NewRequest(http.MethodPut, ts.URL, prepareParams(t, params))
+		request.Header.Set("Authorization", "Bearer "+adminJWT)
+		resp := doRequest(request, err)
+		assertStatus(t, 200, resp)
+
+		usr, _ := us.repository.Get(target.Email)
+		if usr.Role != RoleAdmin {
+			t.Errorf("role = %s; want admin", usr.Role)
+		}
+		auth, err := j.ParseJWT(targetJWT)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !j.revocations.IsRevoked(auth.Id) {
+			t.Error("token with the old role was not revoked")
+		}
+	})
+	t.Run("rejects unknown role", func(t *testing.T) {
+		params := map[string]interface{}{"email": target.Email, "role": "owner"}
+		request, err := http.NewRequest(http.MethodPut, ts.URL, prepareParams(t, params))
+		request.Header.Set("Authorization", "Bearer "+adminJWT)
+		resp := doRequest(request, err)
+		assertStatus(t, 422, resp)
+	})
+	t.Run("rejects own role change", func(t *testing.T) {
+		params := map[string]interface{}{"email": admin.Email, "role": "user"}
+		request, err := http.NewRequest(http.MethodPut, ts.URL, prepareParams(t, params))
+		request.Header.Set("Authorization", "Bearer "+adminJWT)
+		resp := doRequest(request, err)
+		assertStatus(t, 403, resp)
+	})
+}
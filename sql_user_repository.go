@@ -0,0 +1,391 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+	"unicode/utf8"
+)
+
+// userMigrations are applied in order, each exactly once; the number of the
+// last applied one is kept in schema_migrations. Never edit a released
+// migration, append a new one instead.
+var userMigrations = []string{
+	// 1: users keyed by the repository key, emails unique.
+	`CREATE TABLE users (
+		id TEXT NOT NULL PRIMARY KEY,
+		email TEXT NOT NULL UNIQUE,
+		password_digest TEXT NOT NULL,
+		favorite_cake TEXT NOT NULL
+	)`,
+	// 2: roles.
+	`ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT ''`,
+	// 3: bans, times in unix nanoseconds.
+	`ALTER TABLE users ADD COLUMN banned_at INTEGER;
+	ALTER TABLE users ADD COLUMN ban_until INTEGER;
+	ALTER TABLE users ADD COLUMN ban_reason TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN banned_by TEXT NOT NULL DEFAULT ''`,
+	// 4: email verification, users added before it count as verified.
+	`ALTER TABLE users ADD COLUMN unverified INTEGER NOT NULL DEFAULT 0`,
+	// 5: the outbox, events in JSON kept in the order they were stored.
+	`CREATE TABLE outbox (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		id TEXT NOT NULL UNIQUE,
+		event TEXT NOT NULL
+	)`,
+}
+
+const userColumns = `id, email, password_digest, favorite_cake, role, banned_at, ban_until, ban_reason, banned_by, unverified`
+
+// SQLUserStorage is a UserRepository on top of database/sql. Queries are
+// written for SQLite.
+type SQLUserStorage struct {
+	db *sql.DB
+}
+
+// NewSQLUserStorage brings the schema up to date and returns the repository.
+func NewSQLUserStorage(db *sql.DB) (*SQLUserStorage, error) {
+	if err := migrate(db, userMigrations); err != nil {
+		return nil, err
+	}
+	return &SQLUserStorage{db: db}, nil
+}
+
+func migrate(db *sql.DB, migrations []string) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER NOT NULL PRIMARY KEY,
+		applied_at INTEGER NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+	var current int
+	err = db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current)
+	if err != nil {
+		return err
+	}
+	if current > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than this binary knows (%d)", current, len(migrations))
+	}
+	for version := current + 1; version <= len(migrations); version++ {
+		err := withTx(db, func(tx *sql.Tx) error {
+			if _, err := tx.Exec(migrations[version-1]); err != nil {
+				return err
+			}
+			_, err := tx.Exec(
+				`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`,
+				version, time.Now().Unix(),
+			)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+	}
+	return nil
+}
+
+func (repository *SQLUserStorage) Add(key string, usr User, events ...Event) error {
+	return withTx(repository.db, func(tx *sql.Tx) error {
+		// Conflicts on either the key or the email leave the row out.
+		result, err := tx.Exec(
+			`INSERT INTO users (`+userColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT DO NOTHING`,
+			userValues(key, usr)...,
+		)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrUserExists
+		}
+		return insertEvents(tx, events)
+	})
+}
+
+func (repository *SQLUserStorage) Update(key string, usr User, events ...Event) error {
+	return withTx(repository.db, func(tx *sql.Tx) error {
+		if _, err := getUser(tx, key); err != nil {
+			return err
+		}
+		return updateUser(tx, key, usr, events)
+	})
+}
+
+// Modify reads and writes the row in one transaction. SQLite lets a single
+// connection write at a time, so a concurrent write makes the transaction
+// fail rather than being overwritten.
+func (repository *SQLUserStorage) Modify(key string, change func(usr *User) ([]Event, error)) (User, error) {
+	var usr User
+	err := withTx(repository.db, func(tx *sql.Tx) error {
+		var err error
+		if usr, err = getUser(tx, key); err != nil {
+			return err
+		}
+		events, err := change(&usr)
+		if err != nil {
+			return err
+		}
+		return updateUser(tx, key, usr, events)
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return usr, nil
+}
+
+func updateUser(tx *sql.Tx, key string, usr User, events []Event) error {
+	var taken int
+	err := tx.QueryRow(`SELECT COUNT(*) FROM users WHERE email = ? AND id <> ?`, usr.Email, key).Scan(&taken)
+	if err != nil {
+		return err
+	}
+	if taken > 0 {
+		return ErrUserExists
+	}
+	values := userValues(key, usr)
+	_, err = tx.Exec(
+		`UPDATE users SET email = ?, password_digest = ?, favorite_cake = ?, role = ?,
+			banned_at = ?, ban_until = ?, ban_reason = ?, banned_by = ?, unverified = ?
+		WHERE id = ?`,
+		append(values[1:], key)...,
+	)
+	if err != nil {
+		return err
+	}
+	return insertEvents(tx, events)
+}
+
+func (repository *SQLUserStorage) Rekey(oldKey, newKey string, change func(usr *User) ([]Event, error)) (User, error) {
+	var usr User
+	err := withTx(repository.db, func(tx *sql.Tx) error {
+		var err error
+		if usr, err = getUser(tx, oldKey); err != nil {
+			return err
+		}
+		events, err := change(&usr)
+		if err != nil {
+			return err
+		}
+		var taken int
+		err = tx.QueryRow(
+			`SELECT COUNT(*) FROM users WHERE (id = ? OR email = ?) AND id <> ?`,
+			newKey, usr.Email, oldKey,
+		).Scan(&taken)
+		if err != nil {
+			return err
+		}
+		if taken > 0 {
+			return ErrUserExists
+		}
+		values := userValues(newKey, usr)
+		_, err = tx.Exec(
+			`UPDATE users SET id = ?, email = ?, password_digest = ?, favorite_cake = ?, role = ?,
+				banned_at = ?, ban_until = ?, ban_reason = ?, banned_by = ?, unverified = ?
+			WHERE id = ?`,
+			append(values, oldKey)...,
+		)
+		if err != nil {
+			return err
+		}
+		return insertEvents(tx, events)
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return usr, nil
+}
+
+func (repository *SQLUserStorage) Get(key string) (User, error) {
+	return getUser(repository.db, key)
+}
+
+func (repository *SQLUserStorage) Delete(key string) (User, error) {
+	var usr User
+	err := withTx(repository.db, func(tx *sql.Tx) error {
+		var err error
+		if usr, err = getUser(tx, key); err != nil {
+			return err
+		}
+		_, err = tx.Exec(`DELETE FROM users WHERE id = ?`, key)
+		return err
+	})
+	return usr, err
+}
+
+func (repository *SQLUserStorage) Count() (int, error) {
+	var count int
+	err := repository.db.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&count)
+	return count, err
+}
+
+func (repository *SQLUserStorage) List(prefix string, offset, limit int) ([]User, int, error) {
+	// substr rather than LIKE: LIKE ignores case in SQLite, the other
+	// repositories match the prefix exactly.
+	prefixLen := utf8.RuneCountInString(prefix)
+	var total int
+	err := repository.db.QueryRow(
+		`SELECT COUNT(*) FROM users WHERE substr(email, 1, ?) = ?`, prefixLen, prefix,
+	).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+	rows, err := repository.db.Query(
+		`SELECT `+userColumns+` FROM users WHERE substr(email, 1, ?) = ?
+		ORDER BY email LIMIT ? OFFSET ?`,
+		prefixLen, prefix, limit, offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	users := make([]User, 0)
+	for rows.Next() {
+		usr, err := scanUser(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		users = append(users, usr)
+	}
+	return users, total, rows.Err()
+}
+
+func (repository *SQLUserStorage) Pending(limit int) ([]Event, error) {
+	rows, err := repository.db.Query(`SELECT event FROM outbox ORDER BY seq LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	events := make([]Event, 0)
+	for rows.Next() {
+		var (
+			data  []byte
+			event Event
+		)
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func (repository *SQLUserStorage) PendingCount() (int, error) {
+	var count int
+	err := repository.db.QueryRow(`SELECT COUNT(*) FROM outbox`).Scan(&count)
+	return count, err
+}
+
+func (repository *SQLUserStorage) Delivered(id string) error {
+	_, err := repository.db.Exec(`DELETE FROM outbox WHERE id = ?`, id)
+	return err
+}
+
+func insertEvents(tx *sql.Tx, events []Event) error {
+	for _, event := range events {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO outbox (id, event) VALUES (?, ?)`, event.ID, string(data)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (repository *SQLUserStorage) Close() error {
+	return repository.db.Close()
+}
+
+type queryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func getUser(q queryer, key string) (User, error) {
+	usr, err := scanUser(q.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, key))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrUserNotFound
+	}
+	return usr, err
+}
+
+func scanUser(row scanner) (User, error) {
+	var (
+		usr                User
+		id                 string
+		bannedAt, banUntil sql.NullInt64
+	)
+	err := row.Scan(
+		&id,
+		&usr.Email,
+		&usr.PasswordDigest,
+		&usr.FavoriteCake,
+		&usr.Role,
+		&bannedAt,
+		&banUntil,
+		&usr.Ban.Reason,
+		&usr.Ban.BannedBy,
+		&usr.Unverified,
+	)
+	if err != nil {
+		return User{}, err
+	}
+	usr.Ban.BannedAt = fromUnixNano(bannedAt)
+	usr.Ban.Until = fromUnixNano(banUntil)
+	return usr, nil
+}
+
+func userValues(key string, usr User) []interface{} {
+	return []interface{}{
+		key,
+		usr.Email,
+		usr.PasswordDigest,
+		usr.FavoriteCake,
+		string(usr.Role),
+		toUnixNano(usr.Ban.BannedAt),
+		toUnixNano(usr.Ban.Until),
+		usr.Ban.Reason,
+		usr.Ban.BannedBy,
+		usr.Unverified,
+	}
+}
+
+func toUnixNano(t time.Time) sql.NullInt64 {
+	if t.IsZero() {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: t.UnixNano(), Valid: true}
+}
+
+func fromUnixNano(n sql.NullInt64) time.Time {
+	if !n.Valid {
+		return time.Time{}
+	}
+	return time.Unix(0, n.Int64)
+}
+
+func withTx(db *sql.DB, f func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
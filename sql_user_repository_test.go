@@ -0,0 +1,214 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func openSQLStorage(t *testing.T, path string) *SQLUserStorage {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	userStor, err := NewSQLUserStorage(db)
+	if err != nil {
+		t.Fatalf("NewSQLUserStorage() = %s; want nil", err)
+	}
+	return userStor
+}
+
+func TestSQLStorageCRUD(t *testing.T) {
+	userStor := openSQLStorage(t, filepath.Join(t.TempDir(), "users.db"))
+	defer userStor.Close()
+	user := User{
+		Email:          "myemail@gmail.com",
+		PasswordDigest: "QwErTy123",
+		FavoriteCake:   "Orange",
+		Role:           RoleAdmin,
+		Unverified:     true,
+	}
+	if err := userStor.Add(user.Email, user); err != nil {
+		t.Fatalf("Add() = %s; want nil", err)
+	}
+	if err := userStor.Add(user.Email, user); err == nil || err.Error() != "The user already exists" {
+		t.Errorf("Add(existing) = %v; want already exists", err)
+	}
+	gotUser, err := userStor.Get(user.Email)
+	if err != nil || gotUser != user {
+		t.Errorf("Get() = %v, %v; want %v", gotUser, err, user)
+	}
+
+	user.Ban = Ban{BannedAt: time.Unix(100, 5), Reason: "spam", BannedBy: "admin@gmail.com"}
+	if err := userStor.Update(user.Email, user); err != nil {
+		t.Fatalf("Update() = %s; want nil", err)
+	}
+	gotUser, _ = userStor.Get(user.Email)
+	if !gotUser.Ban.BannedAt.Equal(user.Ban.BannedAt) || !gotUser.Ban.Until.IsZero() || gotUser.Ban.Reason != "spam" {
+		t.Errorf("Get().Ban = %+v; want %+v", gotUser.Ban, user.Ban)
+	}
+	if err := userStor.Update("nick", user); err == nil || err.Error() != "The user doesn't exist" {
+		t.Errorf("Update(unexisting) = %v; want doesn't exist", err)
+	}
+
+	deleted, err := userStor.Delete(user.Email)
+	if err != nil || deleted.Email != user.Email {
+		t.Errorf("Delete() = %v, %v; want %v", deleted, err, user)
+	}
+	if _, err := userStor.Get(user.Email); err == nil || err.Error() != "The user doesn't exist" {
+		t.Errorf("Get(deleted) = %v; want doesn't exist", err)
+	}
+	if _, err := userStor.Delete(user.Email); err == nil {
+		t.Error("Delete(deleted) = nil; want error")
+	}
+}
+
+func TestSQLStorageUniqueEmail(t *testing.T) {
+	userStor := openSQLStorage(t, filepath.Join(t.TempDir(), "users.db"))
+	defer userStor.Close()
+	userStor.Add("nick", User{Email: "myemail@gmail.com"})
+	if err := userStor.Add("john", User{Email: "myemail@gmail.com"}); err == nil {
+		t.Error("Add(same email) = nil; want error")
+	}
+	userStor.Add("john", User{Email: "john@gmail.com"})
+	if err := userStor.Update("john", User{Email: "myemail@gmail.com"}); err == nil {
+		t.Error("Update(to taken email) = nil; want error")
+	}
+}
+
+func TestSQLStorageMigrations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.db")
+	userStor := openSQLStorage(t, path)
+	userStor.Add("myemail@gmail.com", User{Email: "myemail@gmail.com"})
+	userStor.Close()
+
+	userStor = openSQLStorage(t, path)
+	var version int
+	userStor.db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version)
+	if version != len(userMigrations) {
+		t.Errorf("schema version = %d; want %d", version, len(userMigrations))
+	}
+	if _, err := userStor.Get("myemail@gmail.com"); err != nil {
+		t.Errorf("Get() after reopening = %s; want nil", err)
+	}
+	userStor.db.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, 0)`, len(userMigrations)+1)
+	userStor.Close()
+
+	db, _ := sql.Open("sqlite3", path)
+	defer db.Close()
+	if _, err := NewSQLUserStorage(db); err == nil {
+		t.Error("NewSQLUserStorage(newer schema) = nil; want error")
+	}
+}
+
+func TestSQLStorageList(t *testing.T) {
+	userStor := openSQLStorage(t, filepath.Join(t.TempDir(), "users.db"))
+	defer userStor.Close()
+	for _, email := range []string{"bob@gmail.com", "alice@gmail.com", "alex@gmail.com", "Al@gmail.com", "a_b@gmail.com"} {
+		userStor.Add(email, User{Email: email})
+	}
+	users, total, err := userStor.List("al", 1, 10)
+	if err != nil {
+		t.Fatalf("List() = %s; want nil", err)
+	}
+	if total != 2 || len(users) != 1 || users[0].Email != "alice@gmail.com" {
+		t.Errorf("List(al, 1) = %v, %d; want alice of 2", users, total)
+	}
+	if _, total, _ := userStor.List("a_", 0, 10); total != 1 {
+		t.Errorf("List(a_) total = %d; want 1", total)
+	}
+	if count, err := userStor.Count(); err != nil || count != 5 {
+		t.Errorf("Count() = %d, %v; want 5", count, err)
+	}
+}
+
+func TestSQLStorageRekey(t *testing.T) {
+	userStor := openSQLStorage(t, filepath.Join(t.TempDir(), "users.db"))
+	defer userStor.Close()
+	user := User{Email: "myemail@gmail.com"}
+	userStor.Add(user.Email, user)
+	userStor.Add("john@gmail.com", User{Email: "john@gmail.com"})
+
+	taken := User{Email: "john@gmail.com"}
+	if _, err := userStor.Rekey(user.Email, taken.Email, replaceUser(taken)); err == nil || err.Error() != "The user already exists" {
+		t.Errorf("Rekey(to taken) = %v; want already exists", err)
+	}
+	if _, err := userStor.Get(user.Email); err != nil {
+		t.Errorf("The user was lost by a failed rekey: %s", err)
+	}
+	if _, err := userStor.Rekey("nick", "bob", replaceUser(user)); err == nil || err.Error() != "The user doesn't exist" {
+		t.Errorf("Rekey(unexisting) = %v; want doesn't exist", err)
+	}
+
+	moved := User{Email: "bob@gmail.com", FavoriteCake: "Lemon"}
+	if _, err := userStor.Rekey(user.Email, moved.Email, replaceUser(moved)); err != nil {
+		t.Fatalf("Rekey() = %s; want nil", err)
+	}
+	if _, err := userStor.Get(user.Email); err == nil {
+		t.Error("Get(old key) = nil; want error")
+	}
+	if gotUser, err := userStor.Get(moved.Email); err != nil || gotUser != moved {
+		t.Errorf("Get(new key) = %v, %v; want %v", gotUser, err, moved)
+	}
+}
+
+func TestSQLStorageOutbox(t *testing.T) {
+	userStor := openSQLStorage(t, filepath.Join(t.TempDir(), "users.db"))
+	defer userStor.Close()
+	user := User{Email: "myemail@gmail.com"}
+	userStor.Add("nick", user, testEvent("1"))
+	if err := userStor.Add("nick", user, testEvent("lost")); err != ErrUserExists {
+		t.Fatalf("Add(existing) = %v; want ErrUserExists", err)
+	}
+	userStor.Rekey("nick", "john", replaceUser(user, testEvent("2")))
+	userStor.Update("john", user, testEvent("3"))
+	userStor.Delivered("2")
+
+	pending, err := userStor.Pending(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count, _ := userStor.PendingCount(); count != 2 || len(pending) != 2 || pending[0].ID != "1" || pending[1].ID != "3" {
+		t.Fatalf("Pending() = %v; want events 1 and 3", pending)
+	}
+	data, _ := json.Marshal(pending[0].Data)
+	if string(data) != `{"email":"1","favorite_cake":"","previous":""}` {
+		t.Errorf("stored data = %s", data)
+	}
+}
+
+func TestSQLStorageModify(t *testing.T) {
+	userStor := openSQLStorage(t, filepath.Join(t.TempDir(), "users.db"))
+	defer userStor.Close()
+	userStor.Add("nick", User{Email: "myemail@gmail.com", FavoriteCake: "Orange"})
+	userStor.Update("nick", User{Email: "myemail@gmail.com", FavoriteCake: "Orange", Role: RoleAdmin})
+
+	got, err := userStor.Modify("nick", func(usr *User) ([]Event, error) {
+		usr.FavoriteCake = "Cheese"
+		return []Event{testEvent("1")}, nil
+	})
+	if err != nil || got.FavoriteCake != "Cheese" || got.Role != RoleAdmin {
+		t.Fatalf("Modify() = %+v, %v; want the cake changed and the role kept", got, err)
+	}
+	refused := ErrEmailTokenInvalid
+	if _, err := userStor.Modify("nick", func(usr *User) ([]Event, error) {
+		usr.FavoriteCake = "Lost"
+		return []Event{testEvent("lost")}, refused
+	}); err != refused {
+		t.Errorf("Modify(failing) = %v; want its error", err)
+	}
+	if _, err := userStor.Modify("john", func(*User) ([]Event, error) { return nil, nil }); err != ErrUserNotFound {
+		t.Errorf("Modify(unexisting) = %v; want ErrUserNotFound", err)
+	}
+
+	stored, _ := userStor.Get("nick")
+	pending, _ := userStor.Pending(10)
+	if stored.FavoriteCake != "Cheese" || len(pending) != 1 || pending[0].ID != "1" {
+		t.Errorf("stored %+v with events %v; want only the first change", stored, pending)
+	}
+}
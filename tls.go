@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+)
+
+const (
+	clientAuthNone     = "none"
+	clientAuthOptional = "optional"
+	clientAuthRequire  = "require"
+)
+
+// CertReloader serves the certificate and client CAs read from the configured
+// files and reads them again on Reload. Every handshake picks the current
+// ones, so a reload only affects new connections and drops none.
+type CertReloader struct {
+	config TLSConfig
+
+	lock      sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+func NewCertReloader(config TLSConfig) (*CertReloader, error) {
+	reloader := &CertReloader{config: config}
+	if err := reloader.Reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// Reload reads the files again. On failure the previous certificate stays in
+// use, so a botched renewal can't take the server down.
+func (c *CertReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.config.CertFile, c.config.KeyFile)
+	if err != nil {
+		return fmt.Errorf("load certificate: %w", err)
+	}
+	var clientCAs *x509.CertPool
+	if c.config.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(c.config.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("load client CAs: %w", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("load client CAs: no certificate in %s", c.config.ClientCAFile)
+		}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.cert = &cert
+	c.clientCAs = clientCAs
+	return nil
+}
+
+// TLSConfig is the server side configuration resolving to the current
+// certificate on every handshake.
+func (c *CertReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c.lock.RLock()
+			defer c.lock.RUnlock()
+			// The server only sets NextProtos on the config it was
+			// given, so this one offers HTTP/2 itself.
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				NextProtos:   []string{"h2", "http/1.1"},
+				Certificates: []tls.Certificate{*c.cert},
+				ClientCAs:    c.clientCAs,
+				ClientAuth:   clientAuthType(c.config.ClientAuth),
+			}, nil
+		},
+	}
+}
+
+// ReloadOn reloads whenever a signal arrives on signals, until ctx is done.
+func (c *CertReloader) ReloadOn(ctx context.Context, signals <-chan os.Signal) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+			if err := c.Reload(); err != nil {
+				logger.Error("could not reload TLS certificate, keeping the old one", Fields{"error": err})
+				continue
+			}
+			logger.Info("reloaded TLS certificate", nil)
+		}
+	}
+}
+
+func clientAuthType(mode string) tls.ClientAuthType {
+	switch mode {
+	case clientAuthOptional:
+		return tls.VerifyClientCertIfGiven
+	case clientAuthRequire:
+		return tls.RequireAndVerifyClientCert
+	default:
+		return tls.NoClientCert
+	}
+}
+
+// redirectToHTTPS sends plain HTTP requests to the same URL on the HTTPS
+// listener at httpsAddr.
+func redirectToHTTPS(httpsAddr string) http.Handler {
+	_, httpsPort, _ := net.SplitHostPort(httpsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if host == "" {
+			handleError(newError(ErrBadRequest, "missing host"), w, r)
+			return
+		}
+		if httpsPort != "" && httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		} else if net.ParseIP(host) != nil && net.ParseIP(host).To4() == nil {
+			host = "[" + host + "]"
+		}
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+}
+
+// serve runs srv with TLS when tlsConfig is set and plain HTTP otherwise.
+// http.ErrServerClosed, what a graceful shutdown returns, isn't an error.
+func serve(srv *http.Server) error {
+	var err error
+	if srv.TLSConfig != nil {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert issues a certificate for 127.0.0.1, self-signed when parent is nil.
+func newTestCert(t *testing.T, name string, isCA bool, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func (c *testCert) write(t *testing.T, dir string) TLSConfig {
+	config := TLSConfig{
+		CertFile:   filepath.Join(dir, "cert.pem"),
+		KeyFile:    filepath.Join(dir, "key.pem"),
+		ClientAuth: clientAuthNone,
+	}
+	if err := ioutil.WriteFile(config.CertFile, c.certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(config.KeyFile, c.keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+func newTLSServer(t *testing.T, certs *CertReloader) *httptest.Server {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	ts.TLS = certs.TLSConfig()
+	ts.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// servedCert returns the certificate the server presents on a new connection.
+func servedCert(t *testing.T, addr string) *x509.Certificate {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0]
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	first := newTestCert(t, "first", false, nil)
+	config := first.write(t, dir)
+	certs, err := NewCertReloader(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := newTLSServer(t, certs)
+	addr := ts.Listener.Addr().String()
+
+	// A connection made before the reload keeps working after it.
+	before, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer before.Close()
+
+	second := newTestCert(t, "second", false, nil)
+	second.write(t, dir)
+	if err := certs.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := servedCert(t, addr).Subject.CommonName; got != "second" {
+		t.Errorf("served %s after reload; want second", got)
+	}
+	if _, err := before.Write([]byte("GET / HTTP/1.1\r\nHost: x\r\n\r\n")); err != nil {
+		t.Errorf("old connection dropped: %v", err)
+	}
+
+	// A broken renewal keeps the certificate in use.
+	ioutil.WriteFile(config.KeyFile, []byte("garbage"), 0600)
+	if err := certs.Reload(); err == nil {
+		t.Error("expected reload to fail")
+	}
+	if got := servedCert(t, addr).Subject.CommonName; got != "second" {
+		t.Errorf("served %s after failed reload; want second", got)
+	}
+}
+
+func TestTLSServesHTTP2(t *testing.T) {
+	certs, err := NewCertReloader(newTestCert(t, "server", false, nil).write(t, t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{
+		Handler:   http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		TLSConfig: certs.TLSConfig(),
+		ErrorLog:  log.New(ioutil.Discard, "", 0),
+	}
+	go srv.ServeTLS(listener, "", "")
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	resp, err := client.Get("https://" + listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("served %s; want HTTP/2", resp.Proto)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "internal CA", true, nil)
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, ca.certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	server := newTestCert(t, "server", false, ca)
+	client := newTestCert(t, "client", false, ca)
+	outsider := newTestCert(t, "outsider", false, nil)
+
+	tests := []struct {
+		mode   string
+		cert   *testCert
+		wantOK bool
+	}{
+		{clientAuthRequire, client, true},
+		{clientAuthRequire, nil, false},
+		{clientAuthRequire, outsider, false},
+		{clientAuthOptional, nil, true},
+		{clientAuthOptional, client, true},
+	}
+	for _, tc := range tests {
+		config := server.write(t, t.TempDir())
+		config.ClientCAFile = caFile
+		config.ClientAuth = tc.mode
+		certs, err := NewCertReloader(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts := newTLSServer(t, certs)
+
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.cert)
+		clientConfig := &tls.Config{RootCAs: roots}
+		if tc.cert != nil {
+			clientConfig.Certificates = []tls.Certificate{tc.cert.tlsCertificate()}
+		}
+		httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+		res, err := httpClient.Get(ts.URL)
+		if err == nil {
+			res.Body.Close()
+		}
+		if (err == nil) != tc.wantOK {
+			name := "none"
+			if tc.cert != nil {
+				name = tc.cert.cert.Subject.CommonName
+			}
+			t.Errorf("client_auth %s with %s certificate: err = %v; want ok %v", tc.mode, name, err, tc.wantOK)
+		}
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	tests := []struct {
+		httpsAddr string
+		host      string
+		want      string
+	}{
+		{":8443", "cake.example:8080", "https://cake.example:8443/user/me?x=1"},
+		{":443", "cake.example", "https://cake.example/user/me?x=1"},
+		{":443", "[::1]:80", "https://[::1]/user/me?x=1"},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://"+tc.host+"/user/me?x=1", nil)
+		rec := httptest.NewRecorder()
+		redirectToHTTPS(tc.httpsAddr).ServeHTTP(rec, req)
+		if rec.Code != http.StatusPermanentRedirect || rec.Header().Get("Location") != tc.want {
+			t.Errorf("%s via %s: got %d %s; want %s", tc.host, tc.httpsAddr, rec.Code, rec.Header().Get("Location"), tc.want)
+		}
+	}
+}
@@ -1,13 +1,15 @@
 package main
 
 import (
-	"errors"
+	"sort"
+	"strings"
 	"sync"
 )
 
 type InMemoryUserStorage struct {
 	lock	sync.RWMutex
 	storage	map[string]User
+	outbox	memoryOutbox
 }
 
 func NewInMemoryUserStorage() *InMemoryUserStorage {
@@ -17,34 +19,53 @@ func NewInMemoryUserStorage() *InMemoryUserStorage {
 	}
 }
 
-func (repository *InMemoryUserStorage) Add(key string, usr User) error {
+func (repository *InMemoryUserStorage) Add(key string, usr User, events ...Event) error {
 	repository.lock.Lock()
 	defer repository.lock.Unlock()
 	if _, ok := repository.storage[key]; ok {
-		return errors.New("The user already exists")
+		return ErrUserExists
 	}
 
 	repository.storage[key] = usr
+	repository.outbox = append(repository.outbox, events...)
 	return nil
 }
 
 // Add should return error if user with given key (login) is already present
 
 
-func (repository *InMemoryUserStorage) Update(key string, usr User) error {
+func (repository *InMemoryUserStorage) Update(key string, usr User, events ...Event) error {
 	repository.lock.Lock()
 	defer repository.lock.Unlock()
 
 	if _, ok := repository.storage[key]; !ok {
-		return errors.New("The user doesn't exist")
+		return ErrUserNotFound
 	}
 	repository.storage[key] = usr
+	repository.outbox = append(repository.outbox, events...)
 
 	return nil
 }
 
 // Update should return error if there is no such user to update
 
+func (repository *InMemoryUserStorage) Modify(key string, change func(usr *User) ([]Event, error)) (User, error) {
+	repository.lock.Lock()
+	defer repository.lock.Unlock()
+
+	usr, ok := repository.storage[key]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	events, err := change(&usr)
+	if err != nil {
+		return User{}, err
+	}
+	repository.storage[key] = usr
+	repository.outbox = append(repository.outbox, events...)
+	return usr, nil
+}
+
 
 func (repository *InMemoryUserStorage) Get(key string) (User, error) {
 	repository.lock.Lock()
@@ -52,7 +73,7 @@ func (repository *InMemoryUserStorage) Get(key string) (User, error) {
 	var returnValue User
 
 	if _, ok := repository.storage[key]; !ok {
-		return returnValue, errors.New("The user doesn't exist")
+		return returnValue, ErrUserNotFound
 	}
 	returnValue = repository.storage[key]
 	return returnValue, nil
@@ -66,7 +87,7 @@ func (repository *InMemoryUserStorage) Delete(key string) (User, error) {
 	var returnValue User
 
 	if _, ok := repository.storage[key]; !ok {
-		return returnValue, errors.New("The user doesn't exist")
+		return returnValue, ErrUserNotFound
 	}
 	returnValue = repository.storage[key]
 	delete(repository.storage, key)
@@ -75,3 +96,80 @@ func (repository *InMemoryUserStorage) Delete(key string) (User, error) {
 
 // Delete should return error if there is no such user to delete
 // Delete should return deleted user
+
+func (repository *InMemoryUserStorage) Rekey(oldKey, newKey string, change func(usr *User) ([]Event, error)) (User, error) {
+	repository.lock.Lock()
+	defer repository.lock.Unlock()
+
+	usr, ok := repository.storage[oldKey]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	if _, ok := repository.storage[newKey]; ok && newKey != oldKey {
+		return User{}, ErrUserExists
+	}
+	events, err := change(&usr)
+	if err != nil {
+		return User{}, err
+	}
+	delete(repository.storage, oldKey)
+	repository.storage[newKey] = usr
+	repository.outbox = append(repository.outbox, events...)
+	return usr, nil
+}
+
+func (repository *InMemoryUserStorage) Pending(limit int) ([]Event, error) {
+	repository.lock.RLock()
+	defer repository.lock.RUnlock()
+	return repository.outbox.pending(limit), nil
+}
+
+func (repository *InMemoryUserStorage) PendingCount() (int, error) {
+	repository.lock.RLock()
+	defer repository.lock.RUnlock()
+	return len(repository.outbox), nil
+}
+
+func (repository *InMemoryUserStorage) Delivered(id string) error {
+	repository.lock.Lock()
+	defer repository.lock.Unlock()
+	repository.outbox.delivered(id)
+	return nil
+}
+
+func (repository *InMemoryUserStorage) Count() (int, error) {
+	repository.lock.RLock()
+	defer repository.lock.RUnlock()
+	return len(repository.storage), nil
+}
+
+// List returns the users whose email starts with prefix ordered by email,
+// skipping offset of them and returning at most limit, along with the total
+// number of matches.
+func (repository *InMemoryUserStorage) List(prefix string, offset, limit int) ([]User, int, error) {
+	repository.lock.RLock()
+	defer repository.lock.RUnlock()
+	users, total := listUsers(repository.storage, prefix, offset, limit)
+	return users, total, nil
+}
+
+func listUsers(storage map[string]User, prefix string, offset, limit int) ([]User, int) {
+	matches := make([]User, 0)
+	for _, usr := range storage {
+		if strings.HasPrefix(usr.Email, prefix) {
+			matches = append(matches, usr)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].Email < matches[j].Email
+	})
+	total := len(matches)
+	if offset >= total {
+		return []User{}, total
+	}
+	matches = matches[offset:]
+	if limit < len(matches) {
+		matches = matches[:limit]
+	}
+	return matches, total
+}
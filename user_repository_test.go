@@ -124,3 +124,68 @@ func TestDeletingExistingUser(t *testing.T) {
 		t.Error("Not the right user was deleted")
 	}
 }
+
+func TestListingUsers(t *testing.T) {
+	userStor := NewInMemoryUserStorage()
+	for _, email := range []string{"bob@gmail.com", "alice@gmail.com", "alex@gmail.com"} {
+		userStor.Add(email, User{Email: email})
+	}
+	users, total, err := userStor.List("al", 0, 10)
+	if err != nil {
+		t.Errorf("List() = %s; want nil", err)
+	}
+	if total != 2 || len(users) != 2 || users[0].Email != "alex@gmail.com" {
+		t.Errorf("List(al) = %v, %d; want alex, alice", users, total)
+	}
+	users, total, _ = userStor.List("", 2, 10)
+	if total != 3 || len(users) != 1 || users[0].Email != "bob@gmail.com" {
+		t.Errorf("List(offset 2) = %v, %d; want bob", users, total)
+	}
+	users, _, _ = userStor.List("", 5, 10)
+	if len(users) != 0 {
+		t.Errorf("List(offset 5) = %v; want empty", users)
+	}
+	if count, _ := userStor.Count(); count != 3 {
+		t.Errorf("Count() = %d; want 3", count)
+	}
+}
+
+// replaceUser is a change for Modify or Rekey that overwrites the stored user.
+func replaceUser(usr User, events ...Event) func(*User) ([]Event, error) {
+	return func(stored *User) ([]Event, error) {
+		*stored = usr
+		return events, nil
+	}
+}
+
+func TestRekeyingUser(t *testing.T) {
+	userStor := NewInMemoryUserStorage()
+	user := User{
+		Email:		"myemail@gmail.com",
+		PasswordDigest:	"QwErTy123",
+		FavoriteCake:	"Orange",
+	}
+	userStor.Add("nick", user)
+	userStor.Add("john", user)
+
+	if _, err := userStor.Rekey("nick", "john", replaceUser(user)); err == nil {
+		t.Errorf("Rekey(nick, john) = nil; want error")
+	}
+	if _, ok := userStor.storage["nick"]; !ok {
+		t.Error("The user was lost by a failed rekey")
+	}
+	if _, err := userStor.Rekey("mike", "bob", replaceUser(user)); err == nil {
+		t.Errorf("Rekey(mike, bob) = nil; want error")
+	}
+
+	user.Email = "new@gmail.com"
+	if _, err := userStor.Rekey("nick", "bob", replaceUser(user)); err != nil {
+		t.Errorf("Rekey(nick, bob) = %s; want nil", err)
+	}
+	if _, ok := userStor.storage["nick"]; ok {
+		t.Error("The old key was not removed")
+	}
+	if userStor.storage["bob"] != user {
+		t.Error("The user was not stored under the new key")
+	}
+}
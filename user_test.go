@@ -9,6 +9,8 @@ import (
 	"testing"
 	"crypto/md5"
 	"regexp"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 type parsedResponse struct {
@@ -47,6 +49,7 @@ func prepareParams(t *testing.T, params map[string]interface{}) io.Reader {
 func newTestUserService() *UserService {
 	return &UserService{
 		repository: NewInMemoryUserStorage(),
+		hasher:     NewUpgradingHasher(&BcryptHasher{Cost: bcrypt.MinCost}),
 	}
 }
 
@@ -63,6 +66,17 @@ func assertBody(t *testing.T, expected string, r parsedResponse) {
 	}
 }
 
+func assertProblem(t *testing.T, status int, detail string, r parsedResponse) Problem {
+	var problem Problem
+	if err := json.Unmarshal(r.body, &problem); err != nil {
+		t.Fatalf("Unexpected response body. Expected problem+json, actual: %s", string(r.body))
+	}
+	if problem.Status != status || problem.Detail != detail {
+		t.Errorf("Unexpected problem. Expected: %d %s, actual: %d %s", status, detail, problem.Status, problem.Detail)
+	}
+	return problem
+}
+
 func assertBodyRegex(t *testing.T, rx string, r parsedResponse) {
 	rex, err := regexp.Compile(rx)
 	if err != nil {
@@ -77,7 +91,7 @@ func TestUsers_JWT(t *testing.T) {
 	doRequest := createRequester(t)
 	t.Run("user does not exist", func(t *testing.T) {
 		u := newTestUserService()
-		j, err := NewJWTService("pubkey.rsa", "privkey.rsa")
+		j, err := NewJWTService(DefaultConfig().JWT)
 		if err != nil {
 			t.FailNow()
 		}
@@ -89,14 +103,254 @@ func TestUsers_JWT(t *testing.T) {
 			"password": "somepass",
 		}
 		resp := doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
-		assertStatus(t, 422, resp)
-		assertBody(t, "invalid login params", resp)
+		assertStatus(t, 401, resp)
+		assertProblem(t, 401, "invalid login params", resp)
 	})
 	t.Run("wrong password", func(t *testing.T) {
-		t.Skip()
+		u := newTestUserService()
+		j, err := NewJWTService(DefaultConfig().JWT)
+		if err != nil {
+			t.FailNow()
+		}
+		passwordDigest, err := u.hasher.Hash("somepass")
+		if err != nil {
+			t.Fatal(err)
+		}
+		u.repository.Add("test@mail.com", User{Email: "test@mail.com", PasswordDigest: passwordDigest})
+		ts := httptest.NewServer(http.HandlerFunc(wrapJwt(j, u.JWT)))
+		defer ts.Close()
+		params := map[string]interface{}{
+			"email":    "test@mail.com",
+			"password": "otherpass",
+		}
+		resp := doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		assertStatus(t, 401, resp)
+		assertProblem(t, 401, "invalid login params", resp)
+	})
+	t.Run("upgrades legacy digest", func(t *testing.T) {
+		u := newTestUserService()
+		j, err := NewJWTService(DefaultConfig().JWT)
+		if err != nil {
+			t.FailNow()
+		}
+		legacy := md5.New().Sum([]byte("somepass"))
+		u.repository.Add("test@mail.com", User{Email: "test@mail.com", PasswordDigest: string(legacy)})
+		ts := httptest.NewServer(http.HandlerFunc(wrapJwt(j, u.JWT)))
+		defer ts.Close()
+		params := map[string]interface{}{
+			"email":    "test@mail.com",
+			"password": "somepass",
+		}
+		resp := doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		assertStatus(t, 200, resp)
+
+		usr, err := u.repository.Get("test@mail.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.hasher.NeedsRehash(usr.PasswordDigest) {
+			t.Errorf("legacy digest was not rehashed: %q", usr.PasswordDigest)
+		}
+		ok, err := u.hasher.Verify("somepass", usr.PasswordDigest)
+		if err != nil || !ok {
+			t.Errorf("rehashed digest does not verify the password")
+		}
 	})
 }
 
+func TestUsers_RefreshJWT(t *testing.T) {
+	doRequest := createRequester(t)
+	login := func(t *testing.T, u *UserService, j *JWTService) TokenPair {
+		passwordDigest, err := u.hasher.Hash("somepass")
+		if err != nil {
+			t.Fatal(err)
+		}
+		u.repository.Add("test@mail.com", User{Email: "test@mail.com", PasswordDigest: passwordDigest})
+		ts := httptest.NewServer(http.HandlerFunc(wrapJwt(j, u.JWT)))
+		defer ts.Close()
+		params := map[string]interface{}{
+			"email":    "test@mail.com",
+			"password": "somepass",
+		}
+		resp := doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		assertStatus(t, 200, resp)
+		var tokens TokenPair
+		if err := json.Unmarshal(resp.body, &tokens); err != nil {
+			t.Fatal(err)
+		}
+		if tokens.AccessToken == "" || tokens.RefreshToken == "" {
+			t.Fatalf("incomplete token pair: %s", resp.body)
+		}
+		return tokens
+	}
+
+	t.Run("rotates refresh token", func(t *testing.T) {
+		u := newTestUserService()
+		j, err := NewJWTService(DefaultConfig().JWT)
+		if err != nil {
+			t.FailNow()
+		}
+		tokens := login(t, u, j)
+		ts := httptest.NewServer(http.HandlerFunc(wrapJwt(j, u.RefreshJWT)))
+		defer ts.Close()
+
+		params := map[string]interface{}{"refresh_token": tokens.RefreshToken}
+		resp := doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		assertStatus(t, 200, resp)
+		var rotated TokenPair
+		if err := json.Unmarshal(resp.body, &rotated); err != nil {
+			t.Fatal(err)
+		}
+		if rotated.RefreshToken == tokens.RefreshToken {
+			t.Errorf("refresh token was not rotated")
+		}
+		if _, err := j.ParseJWT(rotated.AccessToken); err != nil {
+			t.Errorf("invalid access token: %s", err)
+		}
+	})
+	t.Run("replayed refresh token revokes family", func(t *testing.T) {
+		u := newTestUserService()
+		j, err := NewJWTService(DefaultConfig().JWT)
+		if err != nil {
+			t.FailNow()
+		}
+		tokens := login(t, u, j)
+		ts := httptest.NewServer(http.HandlerFunc(wrapJwt(j, u.RefreshJWT)))
+		defer ts.Close()
+
+		params := map[string]interface{}{"refresh_token": tokens.RefreshToken}
+		resp := doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		assertStatus(t, 200, resp)
+		var rotated TokenPair
+		json.Unmarshal(resp.body, &rotated)
+
+		resp = doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		assertStatus(t, 401, resp)
+
+		params = map[string]interface{}{"refresh_token": rotated.RefreshToken}
+		resp = doRequest(http.NewRequest(http.MethodPost, ts.URL, prepareParams(t, params)))
+		assertStatus(t, 401, resp)
+	})
+}
+
+func TestLogout(t *testing.T) {
+	doRequest := createRequester(t)
+
+	t.Run("revokes access and refresh tokens", func(t *testing.T) {
+		u := newTestUserService()
+		j, err := NewJWTService(DefaultConfig().JWT)
+		if err != nil {
+			t.FailNow()
+		}
+		user := User{Email: "test@mail.com", FavoriteCake: "citrus"}
+		u.repository.Add(user.Email, user)
+		tokens, err := j.IssueTokens(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		logout := httptest.NewServer(http.HandlerFunc(j.AuthenticationJWT(u.repository, j.Logout)))
+		defer logout.Close()
+		params := map[string]interface{}{"refresh_token": tokens.RefreshToken}
+		request, err := http.NewRequest(http.MethodPost, logout.URL, prepareParams(t, params))
+		request.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+		resp := doRequest(request, err)
+		assertStatus(t, 200, resp)
+
+		request, err = http.NewRequest(http.MethodPost, logout.URL, prepareParams(t, params))
+		request.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+		resp = doRequest(request, err)
+		assertStatus(t, 401, resp)
+
+		if _, err := j.RefreshTokens(tokens.RefreshToken, u.repository); err == nil {
+			t.Errorf("refresh token is still valid after logout")
+		}
+	})
+
+	t.Run("refuses the refresh token of someone else", func(t *testing.T) {
+		u := newTestUserService()
+		j, err := NewJWTService(DefaultConfig().JWT)
+		if err != nil {
+			t.FailNow()
+		}
+		user := User{Email: "test@mail.com", FavoriteCake: "citrus"}
+		victim := User{Email: "victim@mail.com", FavoriteCake: "cheese"}
+		u.repository.Add(user.Email, user)
+		u.repository.Add(victim.Email, victim)
+		tokens, err := j.IssueTokens(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		victimTokens, err := j.IssueTokens(victim)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		logout := httptest.NewServer(http.HandlerFunc(j.AuthenticationJWT(u.repository, j.Logout)))
+		defer logout.Close()
+		params := map[string]interface{}{"refresh_token": victimTokens.RefreshToken}
+		request, err := http.NewRequest(http.MethodPost, logout.URL, prepareParams(t, params))
+		request.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+		resp := doRequest(request, err)
+		assertStatus(t, 401, resp)
+
+		if _, err := j.RefreshTokens(victimTokens.RefreshToken, u.repository); err != nil {
+			t.Errorf("refresh token of another user was revoked: %v", err)
+		}
+	})
+}
+
+func TestCredentialChangeRevokesTokens(t *testing.T) {
+	doRequest := createRequester(t)
+
+	for name, update := range map[string]map[string]interface{}{
+		"password": {"password": "QWERTy123"},
+		"email":    {"email": "new@mail.com"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			u := newTestUserService()
+			j, err := NewJWTService(DefaultConfig().JWT)
+			if err != nil {
+				t.FailNow()
+			}
+			u.tokens = j
+			user := User{Email: "test@mail.com", FavoriteCake: "citrus"}
+			u.repository.Add(user.Email, user)
+			tokens, err := j.IssueTokens(user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			other, err := j.GenearateJWT(user)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			handler := u.UpdatePassword
+			if name == "email" {
+				handler = u.UpdateEmail
+			}
+			ts := httptest.NewServer(http.HandlerFunc(j.AuthenticationJWT(u.repository, handler)))
+			defer ts.Close()
+			request, err := http.NewRequest(http.MethodPut, ts.URL, prepareParams(t, update))
+			request.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+			resp := doRequest(request, err)
+			assertStatus(t, 200, resp)
+
+			me := httptest.NewServer(http.HandlerFunc(j.AuthenticationJWT(u.repository, u.GetCake)))
+			defer me.Close()
+			for _, token := range []string{tokens.AccessToken, other} {
+				request, err := http.NewRequest(http.MethodGet, me.URL, nil)
+				request.Header.Set("Authorization", "Bearer "+token)
+				resp := doRequest(request, err)
+				assertStatus(t, 401, resp)
+			}
+			if _, err := j.RefreshTokens(tokens.RefreshToken, u.repository); err == nil {
+				t.Errorf("refresh token is still valid after %s change", name)
+			}
+		})
+	}
+}
+
 func TestRegisterWithInvalidEmail(t *testing.T) {
 	createReq := createRequester(t)
 
@@ -168,7 +422,7 @@ func TestCakeUpdate(t *testing.T) {
 
 	t.Run("updates cake", func(t *testing.T) {
 		us := newTestUserService()
-		j, err := NewJWTService("public.rsa", "privkey.rsa")
+		j, err := NewJWTService(DefaultConfig().JWT)
 		if err != nil {
 			t.FailNow()
 		}
@@ -179,10 +433,13 @@ func TestCakeUpdate(t *testing.T) {
 			FavoriteCake: "citrus",
 		}
 
-		passwordHashing := md5.New().Sum([]byte(userParams.Password))
+		passwordHashing, err := us.hasher.Hash(userParams.Password)
+		if err != nil {
+			t.Fatal(err)
+		}
 		user := User{
 			Email:          userParams.Email,
-			PasswordDigest: string(passwordHashing),
+			PasswordDigest: passwordHashing,
 			FavoriteCake:   userParams.FavoriteCake,
 		}
 		err = us.repository.Add(userParams.Email, user)
@@ -203,6 +460,7 @@ func TestCakeUpdate(t *testing.T) {
 		}
 
 		request, err := http.NewRequest(http.MethodGet, ts.URL, prepareParams(t, params))
+		request.Header.Set("Authorization", "Bearer "+jwt)
 		resp := createReq(request, err)
 		assertStatus(t, 200, resp)
 		assertBody(t, "updated", resp)
@@ -222,7 +480,7 @@ func TestEmailUpdate(t *testing.T) {
 
 	t.Run("updates cake", func(t *testing.T) {
 		us := newTestUserService()
-		j, err := NewJWTService("public.rsa", "privkey.rsa")
+		j, err := NewJWTService(DefaultConfig().JWT)
 		if err != nil {
 			t.FailNow()
 		}
@@ -233,10 +491,13 @@ func TestEmailUpdate(t *testing.T) {
 			FavoriteCake: "citrus",
 		}
 
-		passwordHashing := md5.New().Sum([]byte(userParams.Password))
+		passwordHashing, err := us.hasher.Hash(userParams.Password)
+		if err != nil {
+			t.Fatal(err)
+		}
 		user := User{
 			Email:          userParams.Email,
-			PasswordDigest: string(passwordHashing),
+			PasswordDigest: passwordHashing,
 			FavoriteCake:   userParams.FavoriteCake,
 		}
 		err = us.repository.Add(userParams.Email, user)
@@ -257,6 +518,7 @@ func TestEmailUpdate(t *testing.T) {
 		}
 
 		request, err := http.NewRequest(http.MethodPut, ts.URL, prepareParams(t, params))
+		request.Header.Set("Authorization", "Bearer "+jwt)
 		resp := createReq(request, err)
 		assertStatus(t, 200, resp)
 		assertBody(t, "updated", resp)
@@ -268,12 +530,45 @@ func TestEmailUpdate(t *testing.T) {
 	})
 }
 
+func TestEmailUpdateToTakenEmail(t *testing.T) {
+	createReq := createRequester(t)
+
+	us := newTestUserService()
+	j, err := NewJWTService(DefaultConfig().JWT)
+	if err != nil {
+		t.FailNow()
+	}
+	user := User{Email: "email@gmail.com", FavoriteCake: "citrus"}
+	us.repository.Add(user.Email, user)
+	us.repository.Add("taken@gmail.com", User{Email: "taken@gmail.com", FavoriteCake: "lemon"})
+	jwt, _ := j.GenearateJWT(user)
+
+	ts := httptest.NewServer(http.HandlerFunc(j.AuthenticationJWT(us.repository, us.UpdateEmail)))
+	defer ts.Close()
+
+	params := map[string]interface{}{
+		"email": "taken@gmail.com",
+	}
+	request, err := http.NewRequest(http.MethodPut, ts.URL, prepareParams(t, params))
+	request.Header.Set("Authorization", "Bearer "+jwt)
+	resp := createReq(request, err)
+	assertStatus(t, 409, resp)
+
+	if _, err := us.repository.Get(user.Email); err != nil {
+		t.Errorf("the account was lost: %s", err)
+	}
+	taken, _ := us.repository.Get("taken@gmail.com")
+	if taken.FavoriteCake != "lemon" {
+		t.Errorf("the other account was overwritten")
+	}
+}
+
 func TestPasswordUpdate(t *testing.T) {
 	createReq := createRequester(t)
 
 	t.Run("updates password", func(t *testing.T) {
 		us := newTestUserService()
-		j, err := NewJWTService("public.rsa", "privkey.rsa")
+		j, err := NewJWTService(DefaultConfig().JWT)
 		if err != nil {
 			t.FailNow()
 		}
@@ -284,10 +579,13 @@ func TestPasswordUpdate(t *testing.T) {
 			FavoriteCake: "citrus",
 		}
 
-		PasswordHashing1 := md5.New().Sum([]byte(userParams.Password))
+		PasswordHashing1, err := us.hasher.Hash(userParams.Password)
+		if err != nil {
+			t.Fatal(err)
+		}
 		user := User{
 			Email:          userParams.Email,
-			PasswordDigest: string(PasswordHashing1),
+			PasswordDigest: PasswordHashing1,
 			FavoriteCake:   userParams.FavoriteCake,
 		}
 		err = us.repository.Add(userParams.Email, user)
@@ -308,6 +606,7 @@ func TestPasswordUpdate(t *testing.T) {
 		}
 
 		request, err := http.NewRequest(http.MethodPut, ts.URL, prepareParams(t, params))
+		request.Header.Set("Authorization", "Bearer "+jwt)
 		resp := createReq(request, err)
 		assertStatus(t, 200, resp)
 		assertBody(t, "updated", resp)
@@ -317,8 +616,8 @@ func TestPasswordUpdate(t *testing.T) {
 			t.Errorf(err.Error())
 		}
 
-		newPasswordHashing := md5.New().Sum([]byte(params["password"].(string)))
-		if usr.PasswordDigest != string(newPasswordHashing) {
+		ok, err := us.hasher.Verify(params["password"].(string), usr.PasswordDigest)
+		if err != nil || !ok {
 			t.Errorf("password is not updated")
 		}
 	})
@@ -329,7 +628,7 @@ func TestCakeGetting(t *testing.T) {
 
 	t.Run("", func(t *testing.T) {
 		us := newTestUserService()
-		j, err := NewJWTService("public.rsa", "privkey.rsa")
+		j, err := NewJWTService(DefaultConfig().JWT)
 		if err != nil {
 			t.FailNow()
 		}
@@ -340,10 +639,13 @@ func TestCakeGetting(t *testing.T) {
 			FavoriteCake: "citrus",
 		}
 
-		passwordDigest := md5.New().Sum([]byte(userParams.Password))
+		passwordDigest, err := us.hasher.Hash(userParams.Password)
+		if err != nil {
+			t.Fatal(err)
+		}
 		user := User{
 			Email:          userParams.Email,
-			PasswordDigest: string(passwordDigest),
+			PasswordDigest: passwordDigest,
 			FavoriteCake:   userParams.FavoriteCake,
 		}
 		err = us.repository.Add(userParams.Email, user)
@@ -367,6 +669,7 @@ func TestCakeGetting(t *testing.T) {
 		params := map[string]interface{}{}
 
 		request, err := http.NewRequest(http.MethodPut, ts.URL, prepareParams(t, params))
+		request.Header.Set("Authorization", "Bearer "+jwt)
 		resp := doRequest(request, err)
 		assertStatus(t, 200, resp)
 		assertBody(t, string(out), resp)
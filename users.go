@@ -3,28 +3,89 @@ package main
 import (
 	"net/mail"
 	"errors"
+	"fmt"
 	"net/http"
-	"crypto/md5"
 	"encoding/json"
-
+	"time"
 )
 
 type User struct {
 	Email string
 	PasswordDigest string
 	FavoriteCake string
+	Role Role
+	Ban Ban
+	// Unverified is set until the user proves to read mail sent to Email.
+	// It is negative so that users stored before verification existed
+	// count as verified.
+	Unverified bool
+}
+
+// Ban is in effect from BannedAt until Until, or forever when Until is zero.
+type Ban struct {
+	BannedAt time.Time
+	Until time.Time
+	Reason string
+	BannedBy string
+}
+
+func (b Ban) Active(now time.Time) bool {
+	return !b.BannedAt.IsZero() && (b.Until.IsZero() || now.Before(b.Until))
+}
+
+var ErrUserBanned = errors.New("user is banned")
+
+// Err explains the ban to the banned user.
+func (b Ban) Err() error {
+	if b.Until.IsZero() {
+		return fmt.Errorf("%w: %s", ErrUserBanned, b.Reason)
+	}
+	return fmt.Errorf("%w until %s: %s", ErrUserBanned, b.Until.UTC().Format(time.RFC3339), b.Reason)
 }
 
+// UserRepository stores users. The events passed to Add and Update, or
+// returned by the change given to Modify and Rekey, go into the outbox in the same atomic write as the change they announce.
 type UserRepository interface {
-	Add(string, User) error
+	Add(key string, usr User, events ...Event) error
 	Get(string) (User, error)
-	Update(string, User) error
+	Update(key string, usr User, events ...Event) error
+	// Modify reads the user, lets change edit it and stores the result
+	// along with the events change returns, all in one atomic write, so
+	// that changes to other fields made meanwhile aren't overwritten. If
+	// change fails nothing is stored. change must not edit the email, use
+	// Rekey for that.
+	Modify(key string, change func(usr *User) ([]Event, error)) (User, error)
 	Delete(string) (User, error)
+	List(prefix string, offset, limit int) ([]User, int, error)
+	// Count is the number of users, cheap enough to ask for on every
+	// metrics scrape.
+	Count() (int, error)
+	// Rekey is Modify for a change that moves the user from oldKey to
+	// newKey. It fails, changing nothing, if oldKey is missing or newKey is
+	// taken.
+	Rekey(oldKey, newKey string, change func(usr *User) ([]Event, error)) (User, error)
+	Outbox
 }
 
 
+// TokenRevoker invalidates the outstanding tokens of a user whose
+// credentials changed.
+type TokenRevoker interface {
+	RevokeUser(email string)
+}
+
 type UserService struct {
 	repository UserRepository
+	hasher PasswordHasher
+	tokens TokenRevoker
+	lockout *LoginLockout
+	// verification is nil when addresses aren't verified.
+	verification *EmailVerification
+	// passwordReset is nil when passwords can't be reset by mail.
+	passwordReset *PasswordReset
+	// relay publishes the events stored with changes; it is told about new
+	// ones so it doesn't wait for its next poll.
+	relay *OutboxRelay
 }
 
 type UserRegisterParams struct {// If it looks strange, read about golang struct tags
@@ -45,51 +106,55 @@ type PasswordUpdate struct {
 	Password string `json:"password"`
 }
 
-func validateRegisterParams(p *UserRegisterParams) error {
-	// 1. Email is valid
-
-	//if _, err := mail.ParseAddress(p.Email); err != nil {
-	//	return err
-	//}
+type RoleUpdate struct {
+	Email string `json:"email"`
+	Role Role `json:"role"`
+}
 
-	if validateEmail(p.Email) != nil {
-		return validateEmail(p.Email)
-	}
+func validateRegisterParams(p *UserRegisterParams) error {
+	// Every field is checked so that the client learns about all of the
+	// invalid ones at once.
+	var errs ValidationErrors
 
+	// 1. Email is valid
 	// 2. Password at least 8 symbols
-
-	if validatePassword(p.Password) != nil {
-		return validatePassword(p.Password)
-	}
-
 	// 3. Favorite cake not empty
 	// 4. Favorite cake only alphabetic
 
-	if validateCake(p.FavoriteCake) != nil {
-		return validateCake(p.FavoriteCake)
+	for _, err := range []error{
+		validateEmail(p.Email),
+		validatePassword(p.Password),
+		validateCake(p.FavoriteCake),
+	} {
+		var invalid *ValidationError
+		if errors.As(err, &invalid) {
+			errs = append(errs, invalid)
+		}
 	}
-	return nil
+	return errs.errOrNil()
 }
 
 func validatePassword(password string) error {
 	if len([]rune(password)) < 8 {
-		return errors.New("The password must be at least 8 symbols")
+		return newValidationError("password", "The password length is less than 8 symbols")
 	}
 	return nil
 }
 
 func validateEmail(email string) error {
-	_, err := mail.ParseAddress(email)
-	return err
+	if _, err := mail.ParseAddress(email); err != nil {
+		return &ValidationError{Field: "email", Err: err}
+	}
+	return nil
 }
 
 func validateCake(cake string) error {
 	if cake == "" {
-		return errors.New("The favorite cake field is empty")
+		return newValidationError("favorite_cake", "The favorite cake field is empty")
 	}
 	for i := 0; i < len([]rune(cake)); i++ {
 		if c := []rune(cake)[i]; c < 65 || (c > 90 && c < 97) || c > 122 {
-			return errors.New("Favorite cake field should not contain only alphabetic values")
+			return newValidationError("favorite_cake", "Favorite cake field should not contain only alphabetic values")
 		}
 	}
 	return nil
@@ -99,53 +164,76 @@ func (u *UserService) Register(w http.ResponseWriter, r *http.Request) {
 	params := &UserRegisterParams{}
 	err := json.NewDecoder(r.Body).Decode(params)
 	if err != nil {
-		handleError(errors.New("could not read params"), w)
+		handleError(newError(ErrBadRequest, "could not read params"), w, r)
 		return
 	}
 	if err := validateRegisterParams(params); err != nil {
-		handleError(err, w)
+		handleError(err, w, r)
+		return
+	}
+	passwordDigest, err := u.hasher.Hash(params.Password)
+	if err != nil {
+		handleError(errors.New("could not hash password"), w, r)
 		return
 	}
-	passwordDigest := md5.New().Sum([]byte(params.Password))
 	newUser := User{
 		Email:		params.Email,
-		PasswordDigest:	string(passwordDigest),
+		PasswordDigest:	passwordDigest,
 		FavoriteCake:	params.FavoriteCake,
+		Role:		RoleUser,
+		Unverified:	u.verification != nil,
 	}
-	err = u.repository.Add(params.Email, newUser)
+	event, err := newEvent(r, EventUserRegistered, UserRegistered{
+		Email:        newUser.Email,
+		FavoriteCake: newUser.FavoriteCake,
+	})
 	if err != nil {
-		handleError(err, w)
+		handleError(err, w, r)
 		return
 	}
+	err = u.repository.Add(params.Email, newUser, event)
+	if err != nil {
+		handleError(err, w, r)
+		return
+	}
+	u.relay.Notify()
+	registrationsTotal.Inc()
+	u.sendVerification(r, newUser.Email)
 	w.WriteHeader(http.StatusCreated)
 	w.Write([]byte("registered"))
 }
 
-func handleError(err error, w http.ResponseWriter) {
-	w.WriteHeader(http.StatusUnprocessableEntity)
-	w.Write([]byte(err.Error()))
-}
-
 func (us *UserService) UpdateCake(w http.ResponseWriter, r *http.Request, user User) {
 	params := &CakeUpdate{}
 	err := json.NewDecoder(r.Body).Decode(params)
 	if err != nil {
-		handleError(errors.New("could not read params"), w)
+		handleError(newError(ErrBadRequest, "could not read params"), w, r)
 		return
 	}
 
 	err = validateCake(params.FavoriteCake)
 	if err != nil {
-		handleError(err, w)
+		handleError(err, w, r)
 		return
 	}
 
-	user.FavoriteCake = params.FavoriteCake
-	err = us.repository.Update(user.Email, user)
+	_, err = us.repository.Modify(user.Email, func(user *User) ([]Event, error) {
+		event, err := newEvent(r, EventUserCakeChanged, UserCakeChanged{
+			Email:        user.Email,
+			FavoriteCake: params.FavoriteCake,
+			Previous:     user.FavoriteCake,
+		})
+		if err != nil {
+			return nil, err
+		}
+		user.FavoriteCake = params.FavoriteCake
+		return []Event{event}, nil
+	})
 	if err != nil {
-		handleError(err, w)
+		handleError(err, w, r)
 		return
 	}
+	us.relay.Notify()
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("updated"))
@@ -155,27 +243,33 @@ func (us *UserService) UpdateEmail(w http.ResponseWriter, r *http.Request, user
 	params := &EmailUpdate{}
 	err := json.NewDecoder(r.Body).Decode(params)
 	if err != nil {
-		handleError(errors.New("could not read params"), w)
+		handleError(newError(ErrBadRequest, "could not read params"), w, r)
 		return
 	}
 
 	err = validateEmail(params.Email)
 	if err != nil {
-		handleError(err, w)
+		handleError(err, w, r)
 		return
 	}
 
-	_, err = us.repository.Delete(user.Email)
-	if err != nil {
-		handleError(err, w)
-		return
-	}
-	user.Email = params.Email
-	err = us.repository.Add(user.Email, user)
+	oldEmail := user.Email
+	user, err = us.repository.Rekey(oldEmail, params.Email, func(usr *User) ([]Event, error) {
+		usr.Email = params.Email
+		usr.Unverified = usr.Unverified || us.verification != nil
+		event, err := newEvent(r, EventUserEmailChanged, UserEmailChanged{OldEmail: oldEmail, NewEmail: usr.Email})
+		if err != nil {
+			return nil, err
+		}
+		return []Event{event}, nil
+	})
 	if err != nil {
-		handleError(err, w)
+		handleError(err, w, r)
 		return
 	}
+	us.relay.Notify()
+	us.revokeTokens(oldEmail)
+	us.sendVerification(r, user.Email)
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("updated"))
@@ -185,33 +279,84 @@ func (us *UserService) UpdatePassword(w http.ResponseWriter, r *http.Request, us
 	params := &PasswordUpdate{}
 	err := json.NewDecoder(r.Body).Decode(params)
 	if err != nil {
-		handleError(errors.New("could not read params"), w)
+		handleError(newError(ErrBadRequest, "could not read params"), w, r)
 		return
 	}
 
 	if err := validatePassword(params.Password); err != nil {
-		handleError(err, w)
+		handleError(err, w, r)
+		return
+	}
+
+	passwordDigest, err := us.hasher.Hash(params.Password)
+	if err != nil {
+		handleError(errors.New("could not hash password"), w, r)
+		return
+	}
+
+	event, err := newEvent(r, EventUserPasswordChanged, UserPasswordChanged{Email: user.Email, Reason: "update"})
+	if err != nil {
+		handleError(err, w, r)
+		return
+	}
+	_, err = us.repository.Modify(user.Email, func(user *User) ([]Event, error) {
+		user.PasswordDigest = passwordDigest
+		return []Event{event}, nil
+	})
+	if err != nil {
+		handleError(err, w, r)
 		return
 	}
+	us.relay.Notify()
+	us.revokeTokens(user.Email)
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("updated"))
+}
 
-	passwordDigest := md5.New().Sum([]byte(params.Password))
-	user.PasswordDigest = string(passwordDigest)
+// UpdateRole changes the role of another user. Tokens carry the role, so the
+// user's outstanding tokens are revoked.
+func (us *UserService) UpdateRole(w http.ResponseWriter, r *http.Request, user User) {
+	params := &RoleUpdate{}
+	err := json.NewDecoder(r.Body).Decode(params)
+	if err != nil {
+		handleError(newError(ErrBadRequest, "could not read params"), w, r)
+		return
+	}
+	if !params.Role.Valid() {
+		handleError(newValidationError("role", "unknown role"), w, r)
+		return
+	}
+	if params.Email == user.Email {
+		handleError(newError(ErrForbidden, "can't change your own role"), w, r)
+		return
+	}
 
-	err = us.repository.Update(user.Email, user)
+	target, err := us.repository.Modify(params.Email, func(target *User) ([]Event, error) {
+		target.Role = params.Role
+		return nil, nil
+	})
 	if err != nil {
-		handleError(err, w)
+		handleError(err, w, r)
 		return
 	}
+	us.revokeTokens(target.Email)
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("updated"))
 }
 
+func (us *UserService) revokeTokens(email string) {
+	if us.tokens != nil {
+		us.tokens.RevokeUser(email)
+	}
+}
+
 func (us *UserService) GetCake(wr http.ResponseWriter, req *http.Request, user User) {
 	user.PasswordDigest = ""
 	out, err := json.Marshal(user)
 	if err != nil {
-		handleError(errors.New("could not encode response"), wr)
+		handleError(errors.New("could not encode response"), wr, req)
 		return
 	}
 
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// mailTimeout bounds sending a single mail from a request.
+const mailTimeout = 10 * time.Second
+
+var ErrEmailUnverified = errors.New("the email address is not verified yet")
+
+// EmailVerification mails new and changed addresses a link proving that the
+// user reads them. Until the link is followed the user is unverified.
+type EmailVerification struct {
+	mailer    Mailer
+	signer    *EmailTokenSigner
+	publicURL string
+	ttl       time.Duration
+}
+
+func NewEmailVerification(mailer Mailer, signer *EmailTokenSigner, publicURL string, ttl time.Duration) *EmailVerification {
+	return &EmailVerification{
+		mailer:    mailer,
+		signer:    signer,
+		publicURL: strings.TrimSuffix(publicURL, "/"),
+		ttl:       ttl,
+	}
+}
+
+func (v *EmailVerification) send(ctx context.Context, email string) error {
+	token, err := v.signer.Sign(emailTokenVerify, email, v.ttl)
+	if err != nil {
+		return err
+	}
+	link := v.publicURL + "/user/verify?token=" + url.QueryEscape(token)
+	ctx, cancel := context.WithTimeout(ctx, mailTimeout)
+	defer cancel()
+	return v.mailer.Send(ctx, MailMessage{
+		To:      email,
+		Subject: "Confirm your email address",
+		Body: "Follow this link to confirm your email address:\n\n" + link +
+			"\n\nThe link expires in " + v.ttl.String() + ". If you didn't sign up, ignore this mail.",
+	})
+}
+
+// sendVerification mails the user a verification link. A failure only gets
+// logged: the change it follows is already stored and the user can ask for
+// another link.
+func (us *UserService) sendVerification(r *http.Request, email string) {
+	if us.verification == nil {
+		return
+	}
+	if err := us.verification.send(r.Context(), email); err != nil {
+		logger.Error("could not send verification mail", Fields{
+			"error":      err,
+			"user":       email,
+			"request_id": requestID(r),
+		})
+	}
+}
+
+// VerifyEmail handles the link mailed by sendVerification.
+func (us *UserService) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	if us.verification == nil {
+		handleError(newError(ErrBadRequest, "email verification is disabled"), w, r)
+		return
+	}
+	email, err := us.verification.signer.Verify(emailTokenVerify, r.URL.Query().Get("token"))
+	if err != nil {
+		handleError(err, w, r)
+		return
+	}
+	user, err := us.repository.Get(email)
+	if errors.Is(err, ErrUserNotFound) {
+		// The address changed again since the link was sent.
+		handleError(ErrEmailTokenInvalid, w, r)
+		return
+	}
+	if err != nil {
+		handleError(err, w, r)
+		return
+	}
+	if user.Unverified {
+		_, err := us.repository.Modify(user.Email, func(user *User) ([]Event, error) {
+			user.Unverified = false
+			return nil, nil
+		})
+		if err != nil {
+			handleError(err, w, r)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("verified"))
+}
+
+// ResendVerification mails the user a fresh link.
+func (us *UserService) ResendVerification(w http.ResponseWriter, r *http.Request, user User) {
+	if us.verification == nil {
+		handleError(newError(ErrBadRequest, "email verification is disabled"), w, r)
+		return
+	}
+	if !user.Unverified {
+		handleError(newError(ErrBadRequest, "the email address is already verified"), w, r)
+		return
+	}
+	if err := us.verification.send(r.Context(), user.Email); err != nil {
+		handleError(err, w, r)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("sent"))
+}
+
+// RequireVerified keeps users who haven't verified their email address out
+// of prHandler.
+func RequireVerified(prHandler ProtectedHandler) ProtectedHandler {
+	return func(w http.ResponseWriter, r *http.Request, user User) {
+		if user.Unverified {
+			handleError(ErrEmailUnverified, w, r)
+			return
+		}
+		prHandler(w, r, user)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEmailTokenSigner(t *testing.T) {
+	now := time.Unix(1000, 0)
+	signer, err := NewEmailTokenSigner(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer.now = func() time.Time { return now }
+
+	token, err := signer.Sign(emailTokenVerify, "cake@mail.com", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject, err := signer.Verify(emailTokenVerify, token); err != nil || subject != "cake@mail.com" {
+		t.Errorf("Verify() = %q, %v; want the subject", subject, err)
+	}
+	if _, err := signer.Verify("reset_password", token); err != ErrEmailTokenInvalid {
+		t.Errorf("other purpose: %v", err)
+	}
+	other, _ := NewEmailTokenSigner([]byte(strings.Repeat("k", 32)))
+	if _, err := other.Verify(emailTokenVerify, token); err != ErrEmailTokenInvalid {
+		t.Errorf("other secret: %v", err)
+	}
+	tampered := strings.Replace(token, token[:4], "eyJz", 1)
+	if _, err := signer.Verify(emailTokenVerify, tampered); err != ErrEmailTokenInvalid {
+		t.Errorf("tampered token: %v", err)
+	}
+	now = now.Add(time.Hour)
+	if _, err := signer.Verify(emailTokenVerify, token); err != ErrEmailTokenInvalid {
+		t.Errorf("expired token: %v", err)
+	}
+}
+
+func TestOutboxMailer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.txt")
+	mailer := NewOutboxMailer(path)
+	msg := MailMessage{To: "cake@mail.com", Subject: "Hi", Body: "Cake!"}
+	if err := mailer.Send(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	if got := mailer.Messages(); len(got) != 1 || got[0] != msg {
+		t.Errorf("Messages() = %v", got)
+	}
+	written, _ := ioutil.ReadFile(path)
+	if !strings.Contains(string(written), "To: cake@mail.com\nSubject: Hi\n\nCake!") {
+		t.Errorf("outbox file: %q", written)
+	}
+}
+
+func TestFormatMailStripsHeaderInjection(t *testing.T) {
+	out := string(formatMail("noreply@cake.test", MailMessage{
+		To:      "cake@mail.com\r\nBcc: everyone@mail.com",
+		Subject: "Hi",
+		Body:    "line 1\nline 2",
+	}))
+	if strings.Contains(out, "\r\nBcc:") {
+		t.Errorf("header injected: %q", out)
+	}
+	if !strings.HasSuffix(out, "\r\n\r\nline 1\r\nline 2") {
+		t.Errorf("unexpected body: %q", out)
+	}
+}
+
+var verifyLink = regexp.MustCompile(`https://cake\.test/user/verify\?token=\S+`)
+
+func TestEmailVerification(t *testing.T) {
+	doRequest := createRequester(t)
+	us := newTestUserService()
+	j, err := NewJWTService(DefaultConfig().JWT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mailer := NewOutboxMailer("")
+	signer, _ := NewEmailTokenSigner(nil)
+	us.verification = NewEmailVerification(mailer, signer, "https://cake.test/", time.Hour)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/user/register", us.Register)
+	mux.HandleFunc("/user/verify", us.VerifyEmail)
+	mux.HandleFunc("/user/verify/resend", j.AuthenticationJWT(us.repository, us.ResendVerification))
+	mux.HandleFunc("/user/favorite_cake", j.AuthenticationJWT(us.repository, RequireVerified(us.UpdateCake)))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	params := map[string]interface{}{
+		"email":         "cake@mail.com",
+		"password":      "cakepass",
+		"favorite_cake": "cheesecake",
+	}
+	assertStatus(t, 201, doRequest(http.NewRequest(http.MethodPost, ts.URL+"/user/register", prepareParams(t, params))))
+	user, _ := us.repository.Get("cake@mail.com")
+	if !user.Unverified {
+		t.Fatal("new user is verified")
+	}
+	sent := mailer.Messages()
+	if len(sent) != 1 || sent[0].To != "cake@mail.com" || !verifyLink.MatchString(sent[0].Body) {
+		t.Fatalf("unexpected mail: %+v", sent)
+	}
+
+	token, _ := j.GenearateJWT(user)
+	if claims, err := j.ParseJWT(token); err != nil || claims.State != "pending" {
+		t.Errorf("state claim = %q, %v; want pending", claims.State, err)
+	}
+	request, err := http.NewRequest(http.MethodPut, ts.URL+"/user/favorite_cake",
+		prepareParams(t, map[string]interface{}{"favorite_cake": "pie"}))
+	request.Header.Set("Authorization", "Bearer "+token)
+	resp := doRequest(request, err)
+	assertProblem(t, 403, "the email address is not verified yet", resp)
+
+	request, err = http.NewRequest(http.MethodPost, ts.URL+"/user/verify/resend", nil)
+	request.Header.Set("Authorization", "Bearer "+token)
+	assertStatus(t, 202, doRequest(request, err))
+	sent = mailer.Messages()
+	if len(sent) != 2 {
+		t.Fatalf("resend sent %d mails in total; want 2", len(sent))
+	}
+
+	assertStatus(t, 400, doRequest(http.NewRequest(http.MethodGet, ts.URL+"/user/verify?token=forged", nil)))
+	link, _ := url.Parse(verifyLink.FindString(sent[1].Body))
+	assertStatus(t, 200, doRequest(http.NewRequest(http.MethodGet, ts.URL+link.RequestURI(), nil)))
+	if user, _ := us.repository.Get("cake@mail.com"); user.Unverified {
+		t.Error("user still unverified after following the link")
+	}
+
+	request, err = http.NewRequest(http.MethodPut, ts.URL+"/user/favorite_cake",
+		prepareParams(t, map[string]interface{}{"favorite_cake": "pie"}))
+	request.Header.Set("Authorization", "Bearer "+token)
+	assertStatus(t, 200, doRequest(request, err))
+}
+
+func TestResendVerificationWhenDisabled(t *testing.T) {
+	us := newTestUserService()
+	request := httptest.NewRequest(http.MethodPost, "/user/verify/resend", nil)
+	rec := httptest.NewRecorder()
+	us.ResendVerification(rec, request, User{Email: "cake@mail.com", Unverified: true})
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "email verification is disabled") {
+		t.Errorf("got %d %s; want 400 email verification is disabled", rec.Code, rec.Body)
+	}
+}
@@ -6,36 +6,69 @@ package ws
 
 import (
 	"bytes"
+	"errors"
 	"log"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-const (
+// Config holds the connection limits of a hub's clients.
+type Config struct {
 	// Time allowed to write a message to the peer.
-	writeWait = 10 * time.Second
+	WriteWait time.Duration `yaml:"write_wait"`
 
 	// Time allowed to read the next pong message from the peer.
-	pongWait = 60 * time.Second
+	PongWait time.Duration `yaml:"pong_wait"`
 
-	// Send pings to peer with this period. Must be less than pongWait.
-	pingPeriod = (pongWait * 9) / 10
+	// Send pings to peer with this period. Must be less than PongWait.
+	PingPeriod time.Duration `yaml:"ping_period"`
 
 	// Maximum message size allowed from peer.
-	maxMessageSize = 512
-)
+	MaxMessageSize int64 `yaml:"max_message_size"`
+
+	ReadBufferSize  int `yaml:"read_buffer_size"`
+	WriteBufferSize int `yaml:"write_buffer_size"`
+}
+
+func DefaultConfig() Config {
+	pongWait := 60 * time.Second
+	return Config{
+		WriteWait:       10 * time.Second,
+		PongWait:        pongWait,
+		PingPeriod:      (pongWait * 9) / 10,
+		MaxMessageSize:  512,
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+	}
+}
+
+// Validate reports the first limit that can't work.
+func (c Config) Validate() error {
+	switch {
+	case c.WriteWait <= 0:
+		return errors.New("write_wait must be positive")
+	case c.PongWait <= 0:
+		return errors.New("pong_wait must be positive")
+	case c.PingPeriod <= 0 || c.PingPeriod >= c.PongWait:
+		return errors.New("ping_period must be positive and less than pong_wait")
+	case c.MaxMessageSize <= 0:
+		return errors.New("max_message_size must be positive")
+	case c.ReadBufferSize <= 0 || c.WriteBufferSize <= 0:
+		return errors.New("buffer sizes must be positive")
+	}
+	return nil
+}
 
 var (
 	newline = []byte{'\n'}
 	space   = []byte{' '}
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-}
+// RequestIDHeader carries the ID of the request that opened a connection.
+const RequestIDHeader = "X-Request-ID"
 
 // Client is a middleman between the websocket connection and the hub.
 type Client struct {
@@ -46,6 +79,10 @@ type Client struct {
 
 	// Buffered channel of outbound messages.
 	send chan []byte
+
+	// requestID is the ID of the upgrade request, logged with everything
+	// that happens on the connection.
+	requestID string
 }
 
 // readPump pumps messages from the websocket connection to the hub.
@@ -55,22 +92,31 @@ type Client struct {
 // reads from this goroutine.
 func (c *Client) readPump() {
 	defer func() {
-		c.hub.unregister <- c
+		select {
+		case c.hub.unregister <- c:
+		case <-c.hub.done:
+		}
 		c.conn.Close()
+		atomic.AddInt64(&connected, -1)
 	}()
-	c.conn.SetReadLimit(maxMessageSize)
-	c.conn.SetReadDeadline(time.Now().Add(pongWait))
-	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	config := c.hub.config
+	c.conn.SetReadLimit(config.MaxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(config.PongWait))
+	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(config.PongWait)); return nil })
 	for {
 		_, message, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("error: %v", err)
+				log.Printf("websocket (request %s): error: %v", c.requestID, err)
 			}
 			break
 		}
 		message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
-		c.hub.broadcast <- message
+		select {
+		case c.hub.broadcast <- message:
+		case <-c.hub.done:
+			return
+		}
 	}
 }
 
@@ -80,7 +126,8 @@ func (c *Client) readPump() {
 // application ensures that there is at most one writer to a connection by
 // executing all writes from this goroutine.
 func (c *Client) writePump() {
-	ticker := time.NewTicker(pingPeriod)
+	config := c.hub.config
+	ticker := time.NewTicker(config.PingPeriod)
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
@@ -88,7 +135,7 @@ func (c *Client) writePump() {
 	for {
 		select {
 		case message, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.conn.SetWriteDeadline(time.Now().Add(config.WriteWait))
 			if !ok {
 				// The hub closed the channel.
 				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
@@ -112,7 +159,7 @@ func (c *Client) writePump() {
 				return
 			}
 		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.conn.SetWriteDeadline(time.Now().Add(config.WriteWait))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
@@ -120,15 +167,28 @@ func (c *Client) writePump() {
 	}
 }
 
-// serveWs handles websocket requests from the peer.
-func serveWs(hub *Hub, w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+// ServeWs handles websocket requests from the peer. requestID identifies the
+// upgrade request; it is echoed in the handshake response, since headers set
+// on w before the upgrade aren't sent, and tags the connection's log lines.
+func ServeWs(hub *Hub, w http.ResponseWriter, r *http.Request, requestID string) {
+	var header http.Header
+	if requestID != "" {
+		header = http.Header{RequestIDHeader: {requestID}}
+	}
+	conn, err := hub.upgrader.Upgrade(w, r, header)
 	if err != nil {
-		log.Println(err)
+		log.Printf("websocket (request %s): %v", requestID, err)
+		return
+	}
+	atomic.AddInt64(&connected, 1)
+	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256), requestID: requestID}
+	select {
+	case client.hub.register <- client:
+	case <-hub.done:
+		conn.Close()
+		atomic.AddInt64(&connected, -1)
 		return
 	}
-	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256)}
-	client.hub.register <- client
 
 	// Allow collection of memory referenced by the caller by doing all work in
 	// new goroutines.
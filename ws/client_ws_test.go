@@ -0,0 +1,59 @@
+package ws
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestConfigValidate(t *testing.T) {
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Fatalf("DefaultConfig().Validate() = %v; want nil", err)
+	}
+	tests := map[string]func(*Config){
+		"write_wait":       func(c *Config) { c.WriteWait = 0 },
+		"pong_wait":        func(c *Config) { c.PongWait = -time.Second },
+		"ping_period":      func(c *Config) { c.PingPeriod = c.PongWait },
+		"max_message_size": func(c *Config) { c.MaxMessageSize = 0 },
+		"buffer sizes":     func(c *Config) { c.WriteBufferSize = 0 },
+	}
+	for setting, breakConfig := range tests {
+		config := DefaultConfig()
+		breakConfig(&config)
+		if err := config.Validate(); err == nil || !strings.HasPrefix(err.Error(), setting) {
+			t.Errorf("Validate() = %v; want an error about %s", err, setting)
+		}
+	}
+}
+
+// serveHub runs a hub until the test ends and serves it, tagging upgrades
+// with requestID.
+func serveHub(t *testing.T, ctx context.Context, requestID string) (*Hub, string) {
+	hub := NewHub(DefaultConfig())
+	go hub.Run(ctx)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ServeWs(hub, w, r, requestID)
+	}))
+	t.Cleanup(ts.Close)
+	return hub, "ws" + strings.TrimPrefix(ts.URL, "http")
+}
+
+func TestServeWsEchoesRequestID(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, url := serveHub(t, ctx, "req-42")
+
+	conn, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := resp.Header.Get(RequestIDHeader); got != "req-42" {
+		t.Errorf("%s = %q; want req-42", RequestIDHeader, got)
+	}
+}
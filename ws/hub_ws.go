@@ -5,10 +5,20 @@
 package ws
 
 import (
-	"math/rand"
-	"time"
+	"context"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
 )
 
+// connected counts the clients with an open connection across all hubs.
+var connected int64
+
+// ClientCount reports how many websocket clients are connected.
+func ClientCount() int {
+	return int(atomic.LoadInt64(&connected))
+}
+
 // Hub maintains the set of active clients and broadcasts messages to the
 // clients.
 type Hub struct {
@@ -23,33 +33,62 @@ type Hub struct {
 
 	// Unregister requests from clients.
 	unregister chan *Client
+
+	// done is closed once Run returned, so that clients stop waiting for
+	// the hub.
+	done chan struct{}
+
+	config   Config
+	upgrader websocket.Upgrader
 }
 
-func newHub() *Hub {
+func NewHub(config Config) *Hub {
 	return &Hub{
+		config: config,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  config.ReadBufferSize,
+			WriteBufferSize: config.WriteBufferSize,
+		},
 		broadcast:  make(chan []byte),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
 		clients:    make(map[*Client]bool),
+		done:       make(chan struct{}),
 	}
 }
 
-func init() {
-	rand.Seed(time.Now().UnixNano())
-}
-
-var letterRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
-
-func createNewMessage(n int) string {
-	b := make([]rune, n)
-	for i := range b {
-		b[i] = letterRunes[rand.Intn(len(letterRunes))]
+// Run registers clients and broadcasts their messages until ctx is done, then
+// closes every connection.
+func (h *Hub) Run(ctx context.Context) {
+	defer func() {
+		close(h.done)
+		for client := range h.clients {
+			close(client.send)
+			delete(h.clients, client)
+		}
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case client := <-h.register:
+			h.clients[client] = true
+		case client := <-h.unregister:
+			if _, ok := h.clients[client]; ok {
+				delete(h.clients, client)
+				close(client.send)
+			}
+		case message := <-h.broadcast:
+			for client := range h.clients {
+				select {
+				case client.send <- message:
+				default:
+					// The client can't keep up; drop it rather than
+					// hold up everyone else.
+					close(client.send)
+					delete(h.clients, client)
+				}
+			}
+		}
 	}
-	return string(b)
-}
-
-func (h *Hub) run() {
-	randNum := rand.Intn(100)
-	message := createNewMessage(randNum)
-	h.broadcast <- []byte(message)
 }
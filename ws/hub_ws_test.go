@@ -0,0 +1,42 @@
+package ws
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestHubRunClosesConnectionsOnShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hub, url := serveHub(t, ctx, "")
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	cancel()
+
+	select {
+	case <-hub.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return after ctx was done")
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	// The hub may close the connection before or after registering it, so
+	// with or without a close frame; either way it must not time out.
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Error("ReadMessage() = nil; want the connection closed")
+	} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		t.Errorf("ReadMessage() = %v; want the connection closed", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ClientCount() != 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("ClientCount() = %d after shutdown; want 0", ClientCount())
+		}
+	}
+}